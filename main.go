@@ -1,23 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"embed"
 	"encoding/base64"
-	"sort"
-	//"encoding/json"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/joho/godotenv" // For .env support
 	"github.com/russross/blackfriday/v2"
@@ -34,11 +48,46 @@ var assetsFS embed.FS
 
 var (
 	hashPassword string // Global variable for the hash password
+	keyID        string // Names the hash in ticket metadata without revealing it
 	demoMode     bool   // Global variable for demo mode
 	fqdn         string // Global variable for the FQDN
 	port         string // Global variable for the port
 	sessionsDir  string // Global variable for the sessions directory
 	logger       = log.New(os.Stdout, "shellHandler: ", log.LstdFlags)
+
+	runAsMode       string   // "", "pool" or "session"; empty runs commands as the server's own user
+	runAsPool       []string // Users (name or uid:gid) handed out to sessions when runAsMode is "pool"
+	runAsPrefix     string   // Prefix for users created on demand when runAsMode is "session"
+	elevateSessions []string // Sessions allowed to request elevate=true, "*" for all
+	identityMu      sync.Mutex
+
+	workspacesDir  string   // Root of the per-session workspace directories
+	sandboxMode    string   // Default sandbox for sessions that did not choose one
+	sandboxNetwork string   // Default network for sandboxed sessions, "host" or "none"
+	sandboxHide    []string // Extra host paths masked inside sandboxes
+	landlockRW     []string // Paths every landlocked session may write besides its workspace
+
+	outputHeadBytes int   // Bytes kept from the start of a ticket's output
+	outputTailBytes int   // Bytes kept from the end of a ticket's output
+	outputDiskBytes int64 // Bytes of full output kept on disk per ticket
+	jobLogBytes     int64 // Bytes of a job's log before it is rotated
+	maxStdinBytes   int   // Largest stdin accepted for a command
+	uploadMaxBytes  int64 // Largest payload assembled by a chunked upload
+	artifactBytes   int64 // Bytes of artifacts kept per ticket
+	workspaceQuota  int64 // Bytes a session workspace may hold, 0 for no limit
+
+	snapshotsDefault bool  // Snapshot workspaces before each ticket unless the session chose
+	snapshotKeep     int   // Snapshots kept per session
+	snapshotMaxFile  int64 // Larger files are left out of snapshots
+
+	watchPaths        []string // Host paths whose changes tickets report besides the workspace
+	changeScanEntries int      // Entries scanned for changes before and after a ticket, 0 to disable
+
+	storageKind string // Backend keeping tickets, their metadata and output: files or sqlite
+	storagePath string // Database file of the sqlite backend
+
+	maxWorkers        int // Tickets executing at once across all sessions
+	maxSessionWorkers int // Tickets executing at once within one session
 )
 
 type TicketResponse struct {
@@ -57,6 +106,11 @@ type CmdSubmission struct {
 	Input    string `json:"input"`
 	B64Input string `json:"b64input,omitempty"` // Add this field
 	Callback string `json:"callback"`
+	Status   string `json:"status,omitempty"`
+	Position int    `json:"position,omitempty"` // Place in the worker queue while QUEUED
+	After    []int  `json:"after,omitempty"`
+	On       string `json:"on,omitempty"`
+	RerunOf  int    `json:"rerun_of,omitempty"`
 }
 
 type CmdResults struct {
@@ -68,17 +122,137 @@ type CmdResults struct {
 	B64Input string `json:"b64input,omitempty"`
 	Output   string `json:"output"`
 	Duration string `json:"duration"`
+	RunAs    string `json:"run_as,omitempty"`
+	Elevated bool   `json:"elevated,omitempty"`
+	Sandbox  string `json:"sandbox,omitempty"`
+	Warning  string `json:"warning,omitempty"`
+	// Size of the full output, Output only holds the head and tail once truncated
+	OutputBytes int64        `json:"output_bytes"`
+	Truncated   bool         `json:"truncated,omitempty"`
+	ExitCode    int          `json:"exit_code"`
+	Steps       []StepResult `json:"steps,omitempty"`
+	Status      string       `json:"status,omitempty"`
+	StdinBytes  int          `json:"stdin_bytes,omitempty"`
+	RerunOf     int          `json:"rerun_of,omitempty"`
+	// Unified diff of the full output against the ticket this one re-runs
+	Diff string `json:"diff,omitempty"`
+	// Watches record how often they ran and the runs whose output changed
+	Runs        int           `json:"runs,omitempty"`
+	ChangeCount int           `json:"change_count,omitempty"`
+	Changes     []WatchChange `json:"changes,omitempty"`
+	StopReason  string        `json:"stop_reason,omitempty"`
+	Artifacts   []Artifact    `json:"artifacts,omitempty"`
+	// Bytes in the session workspace after the ticket ran, with WORKSPACE_QUOTA
+	WorkspaceBytes int64 `json:"workspace_bytes,omitempty"`
+	WorkspaceQuota int64 `json:"workspace_quota,omitempty"`
+	// Summary of the workspace snapshot taken before the ticket ran
+	Snapshot string `json:"snapshot,omitempty"`
+	// Files created, modified or deleted in the workspace and WATCH_PATHS
+	// while the ticket ran. FileScan is empty when they were not tracked.
+	FileChanges     []FileChange `json:"file_changes,omitempty"`
+	FileChangeCount int          `json:"file_change_count,omitempty"`
+	FileScan        string       `json:"file_scan,omitempty"`
+}
+
+// Artifact is a file a ticket produced, kept in the ticket's artifacts
+// folder under Name. Globs that could not be captured only set Error.
+type Artifact struct {
+	Path   string `json:"path"`
+	Name   string `json:"name,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// WatchChange is a run of a watched command whose output differed from the
+// previous change. The first change holds the output, later ones a diff.
+type WatchChange struct {
+	Run      int       `json:"run"`
+	At       time.Time `json:"at"`
+	ExitCode int       `json:"exit_code"`
+	Output   string    `json:"output,omitempty"`
+	Diff     string    `json:"diff,omitempty"`
+}
+
+// StepResult is the outcome of one command in a batch
+type StepResult struct {
+	Step        int    `json:"step"`
+	Input       string `json:"input"`
+	Status      string `json:"status"`
+	ExitCode    int    `json:"exit_code"`
+	Duration    string `json:"duration,omitempty"`
+	Output      string `json:"output"`
+	OutputBytes int64  `json:"output_bytes"`
+	Truncated   bool   `json:"truncated,omitempty"`
+	StdinBytes  int    `json:"stdin_bytes,omitempty"`
+}
+
+// Identity is the unprivileged user a session's commands are executed as.
+type Identity struct {
+	User   string   `json:"user"`
+	UID    uint32   `json:"uid"`
+	GID    uint32   `json:"gid"`
+	Groups []uint32 `json:"groups,omitempty"`
+	Home   string   `json:"home,omitempty"`
+}
+
+// SessionConfig is persisted as session.json inside each session folder.
+type SessionConfig struct {
+	RunAs   *Identity `json:"run_as,omitempty"`
+	Sandbox string    `json:"sandbox,omitempty"` // "none", "namespace" or "landlock"
+	Network string    `json:"network,omitempty"` // "host" or "none", only used by the namespace sandbox
+	// Extra paths a landlocked session may write, on top of its workspace and LANDLOCK_RW
+	ReadWrite []string `json:"read_write,omitempty"`
+	// Snapshot the workspace before each ticket, nil follows SNAPSHOTS
+	Snapshots *bool `json:"snapshots,omitempty"`
+}
+
+// sandboxSpec is handed to the sandbox init helper through the environment
+type sandboxSpec struct {
+	Workspace  string        `json:"workspace"`
+	Namespaces bool          `json:"namespaces"`
+	Hostname   string        `json:"hostname"`
+	Network    bool          `json:"network"`
+	Hide       []string      `json:"hide,omitempty"`
+	Landlock   *landlockSpec `json:"landlock,omitempty"`
+	Identity   *Identity     `json:"identity,omitempty"`
+	Argv       []string      `json:"argv"`
+	Env        []string      `json:"env"`
+}
+
+// landlockSpec lists the paths a landlocked command may read and write
+type landlockSpec struct {
+	ReadOnly  []string `json:"read_only"`
+	ReadWrite []string `json:"read_write"`
 }
 
 const (
 	callback          = "%s/callback?hash=%s&session=%s&ticket=%d"
+	outputLink        = "%s/output?hash=%s&session=%s&ticket=%d&offset=0&limit=%d"
+	artifactLink      = "%s/artifact?hash=%s&session=%s&ticket=%d&path=%s"
 	errorMessage      = "An error occurred while processing your request."
 	errHashMessage    = "Invalid or missing 'hash' parameter"
-	errSessionMessage = "Invalid or missing 'session' parameter"
+	errSessionMessage = "Invalid or missing 'session' parameter, use 1 to 64 letters, digits, '_' or '-'"
 	errTicketMessage  = "Invalid or missing 'ticket' parameter"
 	errCmdMessage     = "Invalid or missing 'cmd' parameter"
+	errRangeMessage   = "Invalid 'offset', 'limit', 'head' or 'tail' parameter"
 	errMethodMessage  = "Method not allowed"
 	errServerMessage  = "Server error"
+	errElevateMessage = "Elevation is not permitted for this session"
+
+	sessionConfigFile = "session.json"
+
+	sandboxNone      = "none"
+	sandboxNamespace = "namespace"
+	sandboxLandlock  = "landlock"
+	sandboxInitArg   = "__llmass_sandbox_init"
+	maxBatchSteps    = 100
+
+	stepSucceeded = "succeeded"
+	stepFailed    = "failed"
+	stepSkipped   = "skipped"
+
+	sandboxSpecEnv = "LLMASS_SANDBOX_SPEC"
 )
 
 func tm(h http.HandlerFunc) http.HandlerFunc {
@@ -107,10 +281,29 @@ func tm(h http.HandlerFunc) http.HandlerFunc {
 
 func main() {
 
+	// The sandbox re-executes this binary to set up its namespaces
+	if len(os.Args) > 1 && os.Args[1] == sandboxInitArg {
+		sandboxInit()
+		return
+	}
+
 	loadEnv()
 
+	var err error
+	store, err = openStorage(storageKind, storagePath)
+	if err != nil {
+		logger.Fatalf("Failed to open storage: %v", err)
+	}
+	defer store.Close()
+	logger.Printf("Keeping tickets in %s storage", storageKind)
+
 	// Check for deadlocks with timeout
 	initSessionCache()
+	initExecutor(maxWorkers, maxSessionWorkers)
+	initScheduler()
+	initTickets()
+	initJobs()
+	initWatches()
 
 	listenAddr := fmt.Sprintf(":%s", port)
 
@@ -129,10 +322,24 @@ func main() {
 	http.HandleFunc("/callback", tm(callbackHandler))
 	http.HandleFunc("/context", tm(contextHandler))
 	http.HandleFunc("/session", tm(sessionHandler))
+	http.HandleFunc("/output", tm(outputHandler))
+	http.HandleFunc("/schedule", tm(scheduleHandler))
+	http.HandleFunc("/schedule/", tm(scheduleHandler))
+	http.HandleFunc("/jobs/", tm(jobsHandler))
+	http.HandleFunc("/rerun", tm(rerunHandler))
+	http.HandleFunc("/watch", tm(watchHandler))
+	http.HandleFunc("/watch/stop", tm(watchHandler))
+	http.HandleFunc("/wait", tm(waitHandler))
+	http.HandleFunc("/upload/", tm(uploadHandler))
+	http.HandleFunc("/file/", tm(fileHandler))
+	http.HandleFunc("/tree", tm(treeHandler))
+	http.HandleFunc("/search", tm(searchHandler))
+	http.HandleFunc("/artifact", tm(artifactHandler))
+	http.HandleFunc("/snapshot/", tm(snapshotHandler))
 	http.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("assets"))))
 	// Start the server using the PORT from .env
 	logger.Printf("Starting server with FQDN: %s on port %s", fqdn, port)
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil {
 		logger.Fatalf("Server failed: %v", err)
 	}
@@ -142,6 +349,14 @@ func Callback(session string, ticket int) string {
 	return fmt.Sprintf(callback, fqdn, hashPassword, session, ticket)
 }
 
+func OutputLink(session string, ticket int) string {
+	return fmt.Sprintf(outputLink, fqdn, hashPassword, session, ticket, outputHeadBytes)
+}
+
+func ArtifactLink(session string, ticket int, name string) string {
+	return fmt.Sprintf(artifactLink, fqdn, hashPassword, session, ticket, url.QueryEscape(name))
+}
+
 func loadEnv() {
 	err := godotenv.Load()
 	if err != nil {
@@ -170,6 +385,8 @@ func loadEnv() {
 	if len(hashPassword) < 32 {
 		logger.Fatalf("HASH must be >= 32 characters: %d", len(hashPassword))
 	}
+	keySum := sha256.Sum256([]byte(hashPassword))
+	keyID = hex.EncodeToString(keySum[:6])
 
 	if fqdn == "" {
 		logger.Fatalf("FQDN must be set in .env file")
@@ -189,7 +406,134 @@ func loadEnv() {
 		logger.Fatalf("Failed to initialize sessions directory: %v", err)
 	}
 
+	runAsMode = os.Getenv("RUN_AS")
+	runAsPool = splitList(os.Getenv("RUN_AS_POOL"))
+	runAsPrefix = os.Getenv("RUN_AS_PREFIX")
+	if runAsPrefix == "" {
+		runAsPrefix = "llmass-"
+	}
+	elevateSessions = splitList(os.Getenv("ELEVATE_SESSIONS"))
+
+	switch runAsMode {
+	case "":
+		logger.Printf("RUN_AS not set, commands will run as the server's own user")
+	case "pool":
+		if len(runAsPool) == 0 {
+			logger.Fatalf("RUN_AS=pool requires RUN_AS_POOL to list at least one user")
+		}
+		for _, entry := range runAsPool {
+			if _, err := lookupIdentity(entry); err != nil {
+				logger.Fatalf("Invalid RUN_AS_POOL entry %q: %v", entry, err)
+			}
+		}
+	case "session":
+		logger.Printf("RUN_AS=session, users will be created on demand with prefix %s", runAsPrefix)
+	default:
+		logger.Fatalf("RUN_AS must be empty, 'pool' or 'session': %s", runAsMode)
+	}
+
+	if len(elevateSessions) > 0 {
+		logger.Printf("Elevation enabled for sessions: %s", strings.Join(elevateSessions, ","))
+	}
+
+	workspacesDir = os.Getenv("WORKSPACES_DIR")
+	if workspacesDir == "" {
+		workspacesDir = "workspaces"
+	}
+	// Workspaces are bind mounted and used as cwd, so keep the path absolute
+	if workspacesDir, err = filepath.Abs(workspacesDir); err != nil {
+		logger.Fatalf("Failed to resolve workspaces directory: %v", err)
+	}
+	if err := os.MkdirAll(workspacesDir, 0755); err != nil {
+		logger.Fatalf("Failed to initialize workspaces directory: %v", err)
+	}
+
+	sandboxMode = os.Getenv("SANDBOX")
+	if sandboxMode == "" {
+		sandboxMode = sandboxNone
+	}
+	if !validSandbox(sandboxMode) {
+		logger.Fatalf("SANDBOX must be 'none', 'namespace' or 'landlock': %s", sandboxMode)
+	}
+	if sandboxNeedsIdentity(sandboxMode) && runAsMode == "" {
+		logger.Fatalf("SANDBOX=%s requires RUN_AS, commands would run as root inside the sandbox", sandboxMode)
+	}
+	sandboxNetwork = os.Getenv("SANDBOX_NETWORK")
+	if sandboxNetwork == "" {
+		sandboxNetwork = "host"
+	}
+	if sandboxNetwork != "host" && sandboxNetwork != "none" {
+		logger.Fatalf("SANDBOX_NETWORK must be 'host' or 'none': %s", sandboxNetwork)
+	}
+	outputHeadBytes = envInt("OUTPUT_HEAD_BYTES", 32*1024)
+	outputTailBytes = envInt("OUTPUT_TAIL_BYTES", 32*1024)
+	outputDiskBytes = int64(envInt("OUTPUT_DISK_BYTES", 256*1024*1024))
+	jobLogBytes = int64(envInt("JOB_LOG_BYTES", 8*1024*1024))
+	maxStdinBytes = envInt("STDIN_MAX_BYTES", 16*1024*1024)
+	uploadMaxBytes = int64(envInt("UPLOAD_MAX_BYTES", 64*1024*1024))
+	artifactBytes = int64(envInt("ARTIFACT_MAX_BYTES", 64*1024*1024))
+	workspaceQuota = int64(envInt("WORKSPACE_QUOTA", 0))
+	snapshotsDefault = os.Getenv("SNAPSHOTS") == "true"
+	snapshotKeep = envInt("SNAPSHOT_KEEP", 20)
+	snapshotMaxFile = int64(envInt("SNAPSHOT_MAX_FILE_BYTES", 16*1024*1024))
+	if snapshotKeep < 1 {
+		logger.Fatalf("SNAPSHOT_KEEP must be at least 1")
+	}
+	changeScanEntries = envInt("CHANGE_SCAN_ENTRIES", 20000)
+	watchPaths = splitList(os.Getenv("WATCH_PATHS"))
+	for _, path := range watchPaths {
+		if !filepath.IsAbs(path) {
+			logger.Fatalf("WATCH_PATHS must be absolute paths: %s", path)
+		}
+	}
+	if jobLogBytes < 1 {
+		logger.Fatalf("JOB_LOG_BYTES must be at least 1")
+	}
+	storageKind = os.Getenv("STORAGE")
+	if storageKind == "" {
+		storageKind = storageFiles
+	}
+	storagePath = os.Getenv("STORAGE_PATH")
+
+	maxWorkers = envInt("MAX_WORKERS", runtime.NumCPU())
+	maxSessionWorkers = envInt("MAX_SESSION_WORKERS", 2)
+	if maxWorkers < 1 || maxSessionWorkers < 1 {
+		logger.Fatalf("MAX_WORKERS and MAX_SESSION_WORKERS must be at least 1")
+	}
+	logger.Printf("Executing up to %d tickets at once, %d per session", maxWorkers, maxSessionWorkers)
+
+	sandboxHide = splitList(os.Getenv("SANDBOX_HIDE"))
+	landlockRW = splitList(os.Getenv("LANDLOCK_RW"))
+	if sandboxMode != sandboxNone {
+		logger.Printf("Sessions default to the %s sandbox with %s network", sandboxMode, sandboxNetwork)
+	}
+}
+
+// envInt reads a non-negative integer env value, falling back to def when unset
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		logger.Fatalf("%s must be a non-negative integer: %s", name, value)
+	}
+	return n
+}
+
+// splitList splits a comma separated env value, dropping empty entries.
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
+
 func getNextTicket(sessionFolder string) (int, error) {
 	// Create the session folder if it doesn't exist
 	err := os.MkdirAll(sessionFolder, 0755)
@@ -247,22 +591,21 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check if session is provided in query parameters
 	session := r.URL.Query().Get("session")
-	if session == "" {
+	if !validSession(session) {
 		writePlainMessage(w, errSessionMessage)
 		return
 	}
 
-	// If session is provided, create the session directory if it doesn't exist
-	sessionFolder := filepath.Join(sessionsDir, session)
-	if _, err := os.Stat(sessionFolder); os.IsNotExist(err) {
-		msg := fmt.Sprintf("Session %s does not exist", sessionFolder)
-		logger.Printf("Session not found!  %s: %v", sessionFolder, err)
+	// Check that the session exists
+	if exists, err := store.SessionExists(session); !exists {
+		msg := fmt.Sprintf("Session %s does not exist", session)
+		logger.Printf("Session not found!  %s: %v", session, err)
 		writePlainMessage(w, msg)
 		return
 	}
 
-	// Read all ticket files in the session
-	file, err := os.ReadFile(filepath.Join(sessionsDir, session, fmt.Sprintf("%02d.ticket", ticket)))
+	// Read the ticket of the session
+	file, err := store.ReadTicket(session, ticket)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to read ticket file: %v", err)
 		writePlainMessage(w, msg)
@@ -270,8 +613,9 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(file) == 0 {
-		msg := fmt.Sprintf("No output for ticket %d yet. Refresh the page after randomly waiting a 1-20 seconds!", ticket)
-		writePlainMessage(w, msg)
+		res, retry := pendingTicket(session, ticket)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+		fmt.Fprint(w, res)
 		return
 	}
 
@@ -279,7 +623,66 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func shellHandler(w http.ResponseWriter, r *http.Request) {
+// Live status of a ticket: what the executor is doing with it, else what
+// its sidecar recorded. Empty for tickets from before sidecars existed.
+func ticketStatus(session string, ticket int) (string, int, *TicketMeta) {
+	meta, _ := store.LoadMeta(session, ticket)
+	if status, position := executor.State(session, ticket); status != "" {
+		return status, position, meta
+	}
+	if meta != nil {
+		return strings.ToUpper(meta.Status), 0, meta
+	}
+	return "", 0, nil
+}
+
+// Describe a ticket that has no result yet, with how long to wait before
+// asking again
+func pendingTicket(session string, ticket int) (string, time.Duration) {
+	status, position, meta := ticketStatus(session, ticket)
+	retry := 5 * time.Second
+
+	res := fmt.Sprintf("HELLO LLM, YOUR TICKET HAS NO RESULT YET!\n\n")
+	res += fmt.Sprintf("SESSION: %s\n\n", session)
+	res += fmt.Sprintf("TICKET: %d\n\n", ticket)
+	if status == "" {
+		status = "UNKNOWN"
+	}
+	res += fmt.Sprintf("STATUS: %s\n\n", status)
+	switch status {
+	case statusQueued:
+		res += fmt.Sprintf("QUEUE_POSITION: %d of %d\n\n", position, executor.Queued())
+		retry = time.Duration(position) * 5 * time.Second
+	case statusWaiting:
+		res += fmt.Sprintf("WAITING_FOR: %s\n\n", joinTickets(executor.Waiting(session, ticket)))
+		retry = 10 * time.Second
+	case statusRunning:
+		if meta != nil && meta.Started != nil {
+			running := time.Since(*meta.Started).Round(time.Second)
+			res += fmt.Sprintf("STARTED: %s (running for %s)\n\n", meta.Started.Format(time.RFC3339), running)
+			// Long commands are checked less often
+			retry = running / 2
+		}
+		if meta != nil && meta.PID > 0 {
+			res += fmt.Sprintf("PID: %d\n\n", meta.PID)
+		}
+	}
+	if retry < 2*time.Second {
+		retry = 2 * time.Second
+	}
+	if retry > time.Minute {
+		retry = time.Minute
+	}
+	res += fmt.Sprintf("NEXT:\n\nCheck this ticket again in %s at %s\n", retry, Callback(session, ticket))
+	return res, retry
+}
+
+const (
+	maxOutputReadBytes = 1024 * 1024 // Most bytes returned by one /output
+	maxOutputKeepBytes = 1024 * 1024 // Most bytes 'head' and 'tail' may each keep
+)
+
+func outputHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	if r.Method != http.MethodGet {
 		writePlainMessage(w, errMethodMessage)
@@ -295,7 +698,74 @@ func shellHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check if session is provided in query parameters
 	session := r.URL.Query().Get("session")
-	if session == "" {
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+
+	ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+	if err != nil {
+		writePlainMessage(w, errTicketMessage)
+		return
+	}
+
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+	limit, err := queryInt(r, "limit", outputHeadBytes)
+	if err != nil || limit == 0 {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+	if limit > maxOutputReadBytes {
+		limit = maxOutputReadBytes
+	}
+
+	buf, size, err := store.ReadOutput(session, ticket, int64(offset), limit)
+	if os.IsNotExist(err) {
+		msg := fmt.Sprintf("No full output for ticket %d: %v", ticket, err)
+		writePlainMessage(w, msg)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to read output: %v", err)
+		writePlainMessage(w, msg)
+		return
+	}
+	n := len(buf)
+
+	res := fmt.Sprintf("HELLO LLM, HERE IS THE REQUESTED OUTPUT RANGE!\n\n")
+	res += fmt.Sprintf("SESSION: %s\n\n", session)
+	res += fmt.Sprintf("TICKET: %d\n\n", ticket)
+	res += fmt.Sprintf("TOTAL_BYTES: %d\n\n", size)
+	res += fmt.Sprintf("RANGE: %d-%d\n\n", offset, offset+n)
+	if next := int64(offset + n); next < size {
+		res += fmt.Sprintf("NEXT:\n\n%s/output?hash=%s&session=%s&ticket=%d&offset=%d&limit=%d\n\n", fqdn, hashPassword, session, ticket, next, limit)
+	}
+	res += fmt.Sprintf("OUTPUT:\n\n%s\n\n", buf[:n])
+	fmt.Fprint(w, res)
+}
+
+func shellHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	// POST is accepted to send the command's stdin as the body
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
 		writePlainMessage(w, errSessionMessage)
 		return
 	}
@@ -303,20 +773,43 @@ func shellHandler(w http.ResponseWriter, r *http.Request) {
 	// Get query parameters
 	cmdParam := r.URL.Query().Get("cmd")
 	b64CmdParam := r.URL.Query().Get("b64cmd")
+	b64BatchParam := r.URL.Query().Get("b64batch")
 
-	if cmdParam == "" && b64CmdParam == "" {
-		writePlainMessage(w, "Invalid or missing 'cmd' or 'b64cmd' parameter")
+	if cmdParam == "" && b64CmdParam == "" && b64BatchParam == "" {
+		writePlainMessage(w, "Invalid or missing 'cmd', 'b64cmd' or 'b64batch' parameter")
 		return
 	}
 
 	// Determine the command to execute
 	var inputCmd string
-	if b64CmdParam != "" {
+	var steps []string
+	var stepStdin [][]byte
+	if b64BatchParam != "" {
+		// A batch runs each decoded step as its own command in one ticket
+		decodedBytes, err := base64.StdEncoding.DecodeString(b64BatchParam)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to decode base64 batch: %v", err)
+			logger.Print(msg)
+			writePlainMessage(w, msg)
+			return
+		}
+		steps, stepStdin, err = parseBatch(string(decodedBytes))
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Invalid batch: %v", err))
+			return
+		}
+		if onError := r.URL.Query().Get("onerror"); onError != "" && onError != "stop" && onError != "continue" {
+			writePlainMessage(w, "Invalid 'onerror' parameter, use 'stop' or 'continue'")
+			return
+		}
+		inputCmd = strings.Join(steps, "\n")
+		b64CmdParam = b64BatchParam
+	} else if b64CmdParam != "" {
 		// Decode base64 command if provided
 		decodedBytes, err := base64.StdEncoding.DecodeString(b64CmdParam)
 		if err != nil {
 			msg := fmt.Sprintf("Failed to decode base64 command: %v", err)
-			logger.Printf(msg)
+			logger.Print(msg)
 			writePlainMessage(w, msg)
 			return
 		}
@@ -333,61 +826,112 @@ func shellHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// If session is provided, create the session directory if it doesn't exist
-	sessionFolder := filepath.Join(sessionsDir, session)
-	if _, err := os.Stat(sessionFolder); os.IsNotExist(err) {
-		if err := os.MkdirAll(sessionFolder, 0755); err != nil {
-			msg := fmt.Sprintf("Failed to create session directory %s: %v", sessionFolder, err)
-			logger.Printf(msg)
-			writePlainMessage(w, msg)
+	// Sessions run as their unprivileged user unless elevation is explicitly allowed
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated {
+		if !canElevate(session) {
+			logger.Printf("Denied elevation for session %s", session)
+			writePlainMessage(w, errElevateMessage)
 			return
 		}
-		logger.Printf("Created new session directory: %s", sessionFolder)
+		logger.Printf("ELEVATED: %s : %s", session, inputCmd)
+	}
+
+	// Per-ticket output caps, defaulting to OUTPUT_HEAD_BYTES and OUTPUT_TAIL_BYTES
+	headBytes, tailBytes, err := queryOutputCaps(r)
+	if err != nil {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+
+	// Tickets of a session run one after another unless marked independent
+	parallel := r.URL.Query().Get("parallel") == "true"
+
+	// Optional dependencies on earlier tickets of the session
+	after, err := parseTicketList(r.URL.Query().Get("after"))
+	if err != nil {
+		writePlainMessage(w, fmt.Sprintf("Invalid 'after' parameter: %v", err))
+		return
+	}
+	on := r.URL.Query().Get("on")
+	if on == "" {
+		on = onSuccess
+	}
+	if on != onSuccess && on != onFailure && on != onAlways {
+		writePlainMessage(w, "Invalid 'on' parameter, use 'success', 'failure' or 'always'")
+		return
+	}
+	// Existing tickets are always earlier than the one about to be allocated
+	for _, dep := range after {
+		if _, err := store.ReadTicket(session, dep); err != nil {
+			writePlainMessage(w, fmt.Sprintf("Invalid 'after' parameter: ticket %d does not exist", dep))
+			return
+		}
+	}
+
+	stdin, err := requestStdin(r)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	artifacts, err := queryArtifacts(r)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
 	}
 
-	isCached := lastCmdMatch(session, inputCmd)
+	// The same command with other stdin is a different command, so only
+	// tickets without stdin are deduplicated. Artifacts belong to the run
+	// that made them, so those tickets always run.
+	isCached := stdin == nil && stepStdin == nil && artifacts == nil && lastCmdMatch(session, inputCmd)
 	if isCached {
 		resp := NewCmdResponse(session, "cached", true)
 		writePlainCsr(w, resp)
 		return
 	}
 
-	// Get the next ticket number
-	ticket, err := getNextTicket(sessionFolder)
+	forest, err := newTicket(r, session, inputCmd, b64CmdParam, elevated)
 	if err != nil {
-		writePlainMessage(w, errTicketMessage)
+		logger.Print(err)
+		writePlainMessage(w, err.Error())
 		return
 	}
+	forest.HeadBytes = headBytes
+	forest.TailBytes = tailBytes
+	forest.Steps = steps
+	forest.StepStdin = stepStdin
+	forest.Stdin = stdin
+	forest.ContinueOnError = r.URL.Query().Get("onerror") == "continue"
+	forest.Parallel = parallel
+	forest.After = after
+	forest.On = on
+	forest.Artifacts = artifacts
 
-	csr := &CmdSubmission{
-		Type:     "asynchronous",
-		Ticket:   ticket,
-		Session:  session,
-		Input:    inputCmd,
-		B64Input: b64CmdParam,
-		IsCached: isCached,
-		Callback: Callback(session, ticket),
-	}
+	csr := forest.CmdSubmission
+	csr.After = after
+	csr.On = on
+	ticket := forest.Ticket
 
-	updateLastCommandByTicketResponse(session, csr)
+	if stdin == nil && stepStdin == nil && artifacts == nil {
+		updateLastCommandByTicketResponse(session, csr)
+	}
 
 	// LOG
 
-	forest := &Runnner{
-		CmdSubmission: csr,
-		Ticket:        ticket,
-		SessionFolder: sessionFolder,
-		InputCmd:      inputCmd,
-	}
-
 	logger.Printf("EXECUTING: %s : %s : %s\n", session, inputCmd, Callback(session, ticket))
+	dispatchTicket(w, r, forest, session)
+}
+
+// Run a prepared ticket in the background, or wait for it in synchronous mode
+func dispatchTicket(w http.ResponseWriter, r *http.Request, forest *Runnner, session string) {
+	csr := forest.CmdSubmission
+	ticket := forest.Ticket
 	////
 	//// insync!!!
 	///
 	if !shouldSync() {
-		go func() {
-			runner(w, r, forest, "asynchronous", session)
-		}()
+		submitTicket(w, r, forest, "asynchronous", session)
+		csr.Status, csr.Position = executor.State(session, ticket)
 		writePlainCsr(w, csr)
 		return
 	}
@@ -395,20 +939,156 @@ func shellHandler(w http.ResponseWriter, r *http.Request) {
 	///
 	/// insync!!!
 	///
-	cer, err := runner(w, r, forest, "synchronous", session)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to execute command: %v", err)
+	result := <-submitTicket(w, r, forest, "synchronous", session)
+	if result.err != nil {
+		msg := fmt.Sprintf("Failed to execute command: %v", result.err)
 		writePlainMessage(w, msg)
 		return
 	}
 
-	writePlainCer(w, cer)
+	writePlainCer(w, result.cer)
 	return
 }
 
+// Allocate and reserve the next ticket of a session for inputCmd, resolving
+// the user and sandbox it runs with. Callers adjust the defaults before
+// handing the ticket to submitTicket.
+func newTicket(r *http.Request, session string, inputCmd string, b64Input string, elevated bool) (*Runnner, error) {
+	forest, err := sessionRunner(session, elevated)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reserve the next ticket so queued tickets keep their number
+	ticket, err := store.AllocateTicket(session)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", errTicketMessage, err)
+	}
+	meta := &TicketMeta{
+		Ticket:   ticket,
+		Status:   ticketQueued,
+		Created:  time.Now(),
+		KeyID:    keyID,
+		Elevated: elevated,
+		Sandbox:  sessionSandbox(forest.Config),
+		Input:    inputCmd,
+		B64Input: b64Input,
+	}
+	if forest.Identity != nil {
+		meta.RunAs = forest.Identity.User
+	}
+	if r != nil {
+		meta.ClientIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+		meta.ForwardedFor = r.Header.Get("X-Forwarded-For")
+	}
+	if err := store.SaveMeta(session, meta); err != nil {
+		logger.Printf("Failed to save metadata of ticket %d of session %s: %v", ticket, session, err)
+	}
+
+	forest.CmdSubmission = &CmdSubmission{
+		Type:     "asynchronous",
+		Ticket:   ticket,
+		Session:  session,
+		Input:    inputCmd,
+		B64Input: b64Input,
+		Callback: Callback(session, ticket),
+	}
+	forest.Ticket = ticket
+	forest.InputCmd = inputCmd
+	return forest, nil
+}
+
+// Resolve the user, config and output limits commands of a session run with
+func sessionRunner(session string, elevated bool) (*Runnner, error) {
+	// If session is provided, create the session directory if it doesn't exist
+	sessionFolder := filepath.Join(sessionsDir, session)
+	if exists, _ := store.SessionExists(session); !exists {
+		if err := store.CreateSession(session); err != nil {
+			return nil, fmt.Errorf("Failed to create session %s: %v", session, err)
+		}
+		logger.Printf("Created new session directory: %s", sessionFolder)
+	}
+
+	var identity *Identity
+	if !elevated {
+		var err error
+		identity, err = resolveIdentity(session)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve user for session %s: %v", session, err)
+		}
+	}
+
+	config, err := loadSessionConfig(sessionFolder)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load config for session %s: %v", session, err)
+	}
+
+	return &Runnner{
+		SessionFolder: sessionFolder,
+		Identity:      identity,
+		Elevated:      elevated,
+		Config:        config,
+		HeadBytes:     outputHeadBytes,
+		TailBytes:     outputTailBytes,
+		On:            onSuccess,
+	}, nil
+}
+
+// ticketResult is delivered once a submitted ticket ran or was cancelled
+type ticketResult struct {
+	cer *CmdResults
+	err error
+}
+
+// Queue a ticket on the executor. The channel receives its results when it
+// finishes, or when it is cancelled because its dependencies did not pass.
+func submitTicket(w http.ResponseWriter, r *http.Request, forest *Runnner, typ string, session string) <-chan ticketResult {
+	if len(forest.Steps) > 0 {
+		updateTicketMeta(session, forest.Ticket, func(meta *TicketMeta) {
+			meta.Steps = forest.Steps
+		})
+	}
+	results := make(chan ticketResult, 1)
+	executor.Submit(&ticketJob{
+		session:  session,
+		ticket:   forest.Ticket,
+		parallel: forest.Parallel,
+		after:    forest.After,
+		on:       forest.On,
+		run: func() {
+			cer, err := runTicket(w, r, forest, typ, session)
+			results <- ticketResult{cer: cer, err: err}
+		},
+		cancel: func(reason string) {
+			results <- ticketResult{cer: cancelTicket(forest, typ, session, reason)}
+		},
+	})
+	return results
+}
+
+// Record a ticket that will never run because of its dependencies
+func cancelTicket(forest *Runnner, typ string, session string, reason string) *CmdResults {
+	cer := &CmdResults{
+		Type:     typ,
+		Next:     "This ticket was cancelled and did not run. You can now issue your next command to /shell",
+		Ticket:   forest.Ticket,
+		Session:  session,
+		Input:    forest.InputCmd,
+		B64Input: forest.CmdSubmission.B64Input,
+		Output:   reason,
+		Duration: "0s",
+		ExitCode: -1,
+		Status:   statusCancelled,
+	}
+	writeTicket(session, forest.Ticket, makePlainCer(cer))
+	finishTicketMeta(cer, ticketCancelled)
+	logger.Printf("CANCELLED: %s : %d : %s", session, forest.Ticket, reason)
+	return cer
+}
+
 func writePlainCsr(w http.ResponseWriter, csr *CmdSubmission) {
 	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, makePlainCsr(csr))
+	fmt.Fprint(w, makePlainCsr(csr))
 }
 
 func makePlainCsr(csr *CmdSubmission) string {
@@ -418,6 +1098,18 @@ func makePlainCsr(csr *CmdSubmission) string {
 	res += fmt.Sprintf("SESSION: %s\n\n", csr.Session)
 	res += fmt.Sprintf("TICKET: %d\n\n", csr.Ticket)
 	res += fmt.Sprintf("CALLBACK: %s\n\n", csr.Callback)
+	if csr.Status != "" {
+		res += fmt.Sprintf("STATUS: %s\n\n", csr.Status)
+	}
+	if csr.Position > 0 {
+		res += fmt.Sprintf("QUEUE_POSITION: %d\n\n", csr.Position)
+	}
+	if len(csr.After) > 0 {
+		res += fmt.Sprintf("AFTER: %s (on %s)\n\n", joinTickets(csr.After), csr.On)
+	}
+	if csr.RerunOf > 0 {
+		res += fmt.Sprintf("RERUN_OF: %d\n\n", csr.RerunOf)
+	}
 	res += fmt.Sprintf("INPUT:\n\n%s\n\n", csr.Input)
 	// Add this conditional section to include B64Input when present
 	if csr.B64Input != "" {
@@ -428,7 +1120,7 @@ func makePlainCsr(csr *CmdSubmission) string {
 
 func writePlainCer(w http.ResponseWriter, cer *CmdResults) {
 	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, makePlainCer(cer))
+	fmt.Fprint(w, makePlainCer(cer))
 }
 
 func makePlainCer(cer *CmdResults) string {
@@ -437,16 +1129,110 @@ func makePlainCer(cer *CmdResults) string {
 	res += fmt.Sprintf("SESSION: %s\n\n", cer.Session)
 	res += fmt.Sprintf("TICKET: %d\n\n", cer.Ticket)
 	res += fmt.Sprintf("DURATION: %s\n\n", cer.Duration)
+	if cer.Status != "" {
+		res += fmt.Sprintf("STATUS: %s\n\n", cer.Status)
+	}
+	if cer.RerunOf > 0 {
+		res += fmt.Sprintf("RERUN_OF: %d\n\n", cer.RerunOf)
+	}
+	if cer.RunAs != "" {
+		res += fmt.Sprintf("RUN_AS: %s\n\n", cer.RunAs)
+	}
+	if cer.Elevated {
+		res += fmt.Sprintf("ELEVATED: %v\n\n", cer.Elevated)
+	}
+	if cer.Sandbox != "" {
+		res += fmt.Sprintf("SANDBOX: %s\n\n", cer.Sandbox)
+	}
+	if cer.Warning != "" {
+		res += fmt.Sprintf("WARNING:\n\n%s\n\n", cer.Warning)
+	}
 	res += fmt.Sprintf("NEXT:\n\n%s\n\n", cer.Next)
 	if cer.B64Input != "" {
 		res += fmt.Sprintf("B64INPUT:\n\n%s\n\n", cer.B64Input)
 	}
 	res += fmt.Sprintf("INPUT:\n\n%s\n\n", cer.Input)
-	res += fmt.Sprintf("OUTPUT:\n\n%s\n\n", cer.Output)
-	return res
-}
-
-func writePlainCmd(w http.ResponseWriter) {
+	if cer.StdinBytes > 0 {
+		res += fmt.Sprintf("STDIN_BYTES: %d\n\n", cer.StdinBytes)
+	}
+	res += fmt.Sprintf("EXIT_CODE: %d\n\n", cer.ExitCode)
+	res += fmt.Sprintf("OUTPUT_BYTES: %d\n\n", cer.OutputBytes)
+	if cer.WorkspaceQuota > 0 {
+		res += fmt.Sprintf("WORKSPACE: %s of %s used\n\n", formatSize(cer.WorkspaceBytes), formatSize(cer.WorkspaceQuota))
+	}
+	if cer.Snapshot != "" {
+		res += fmt.Sprintf("SNAPSHOT: %s\n\n", cer.Snapshot)
+	}
+	if cer.FileScan != "" {
+		res += fmt.Sprintf("FILE_CHANGES: %d", cer.FileChangeCount)
+		if cer.FileChangeCount > len(cer.FileChanges) {
+			res += fmt.Sprintf(" (showing the first %d)", len(cer.FileChanges))
+		}
+		if cer.FileScan != fileScanComplete {
+			res += fmt.Sprintf(" (%s)", cer.FileScan)
+		}
+		res += fmt.Sprintf("\n\n")
+		if len(cer.FileChanges) > 0 {
+			res += fmt.Sprintf("%s\n", formatChanges(cer.FileChanges))
+		}
+	}
+	if cer.RerunOf > 0 {
+		res += fmt.Sprintf("DIFF:\n\n%s\n\n", cer.Diff)
+	}
+	if cer.Runs > 0 {
+		res += fmt.Sprintf("RUNS: %d\n\n", cer.Runs)
+		if cer.StopReason != "" {
+			res += fmt.Sprintf("STOPPED: %s\n\n", cer.StopReason)
+		}
+		res += fmt.Sprintf("CHANGES: %d", cer.ChangeCount)
+		if cer.ChangeCount > len(cer.Changes) {
+			res += fmt.Sprintf(" (showing the last %d, all of them are in the full output)", len(cer.Changes))
+		}
+		res += fmt.Sprintf("\n\n")
+		for _, change := range cer.Changes {
+			res += fmt.Sprintf("--- CHANGED AT %s (run %d, exit code %d) ---\n\n", change.At.Format("15:04:05"), change.Run, change.ExitCode)
+			if change.Diff != "" {
+				res += fmt.Sprintf("%s\n\n", change.Diff)
+			} else {
+				res += fmt.Sprintf("%s\n\n", change.Output)
+			}
+		}
+	}
+	if len(cer.Artifacts) > 0 {
+		res += fmt.Sprintf("ARTIFACTS:\n\n")
+		for _, artifact := range cer.Artifacts {
+			if artifact.Error != "" {
+				res += fmt.Sprintf("%s: %s\n", artifact.Path, artifact.Error)
+				continue
+			}
+			res += fmt.Sprintf("%s (%s, sha256 %s)\n%s\n", artifact.Name, formatSize(artifact.Bytes), artifact.SHA256, ArtifactLink(cer.Session, cer.Ticket, artifact.Name))
+		}
+		res += fmt.Sprintf("\n")
+	}
+	if len(cer.Steps) > 0 {
+		res += fmt.Sprintf("STEPS:\n\n")
+		for _, step := range cer.Steps {
+			res += fmt.Sprintf("--- STEP %d ---\n\n", step.Step)
+			res += fmt.Sprintf("STATUS: %s\n\n", step.Status)
+			if step.Status == stepSkipped {
+				res += fmt.Sprintf("INPUT:\n\n%s\n\n", step.Input)
+				continue
+			}
+			res += fmt.Sprintf("EXIT_CODE: %d\n\n", step.ExitCode)
+			res += fmt.Sprintf("DURATION: %s\n\n", step.Duration)
+			res += fmt.Sprintf("INPUT:\n\n%s\n\n", step.Input)
+			if step.StdinBytes > 0 {
+				res += fmt.Sprintf("STDIN_BYTES: %d\n\n", step.StdinBytes)
+			}
+			res += fmt.Sprintf("OUTPUT:\n\n%s\n\n", step.Output)
+		}
+		return res
+	}
+	res += fmt.Sprintf("OUTPUT:\n\n%s\n\n", cer.Output)
+	return res
+}
+
+func writePlainCmd(w http.ResponseWriter) {
 }
 
 type Runnner struct {
@@ -454,31 +1240,51 @@ type Runnner struct {
 	SessionFolder string
 	InputCmd      string
 	CmdSubmission *CmdSubmission
+	Identity      *Identity // nil runs as the server's own user
+	Elevated      bool
+	Config        *SessionConfig
+	HeadBytes     int
+	TailBytes     int
+	// Batches run each step as its own command instead of InputCmd
+	Steps           []string
+	ContinueOnError bool
+	// Piped to the command, or to each batch step without a StepStdin
+	Stdin     []byte
+	StepStdin [][]byte
+	// Scheduling: parallel tickets skip the session's serial order, After
+	// holds the ticket until those tickets finished with outcome On
+	Parallel bool
+	After    []int
+	On       string
+	// Re-runs diff their output against this earlier ticket
+	RerunOf int
+	// Globs of files copied next to the ticket once it ran
+	Artifacts []string
 }
 
 func runner(w http.ResponseWriter, r *http.Request, runner *Runnner, typ string, session string) (*CmdResults, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), ticketTimeout)
 	defer cancel()
 
-	// Define output filename based on session and ticket
-	outputFile := filepath.Join(runner.SessionFolder, fmt.Sprintf("%02d.ticket", runner.Ticket))
-	file, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// Keep the full output in storage and only the head and tail in memory
+	full, err := store.CreateOutput(session, runner.Ticket)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to open output file %s: %v", outputFile, err)
+		msg := fmt.Sprintf("Failed to open the output of ticket %d: %v", runner.Ticket, err)
 		logger.Print(msg)
 		return nil, fmt.Errorf("%s", msg)
 	}
-	defer file.Close()
+	defer full.Close()
 
-	start := time.Now()
-	// Execute the command using a shell to preserve quotes and complex syntax
-	cmd := exec.CommandContext(ctx, "/bin/bash", "-c", runner.InputCmd) // Use "cmd" /C on Windows if needed
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		msg := fmt.Sprintf("Command execution failed : %s : %v", string(output), err)
-		logger.Print(msg)
-		// WARNING: don't return
-		// falled through so we can write the error to file
+	// Keep the stdin next to the ticket so /rerun can feed it again
+	if len(runner.Stdin) > 0 {
+		if err := os.WriteFile(ticketStdinPath(runner.SessionFolder, runner.Ticket), runner.Stdin, 0600); err != nil {
+			logger.Printf("Failed to save stdin of ticket %d: %v", runner.Ticket, err)
+		}
+	}
+
+	runAs := ""
+	if runner.Identity != nil {
+		runAs = runner.Identity.User
 	}
 	cer := &CmdResults{
 		Type:     typ,
@@ -487,18 +1293,636 @@ func runner(w http.ResponseWriter, r *http.Request, runner *Runnner, typ string,
 		Session:  session,
 		Input:    runner.InputCmd,
 		B64Input: runner.CmdSubmission.B64Input, // Add this line
-		Output:   string(output),
-		Duration: time.Since(start).String(),
+		RunAs:    runAs,
+		Elevated: runner.Elevated,
+		Sandbox:  sessionSandbox(runner.Config),
+		RerunOf:  runner.RerunOf,
+
+		StdinBytes: len(runner.Stdin),
+	}
+
+	if sessionSnapshots(runner.Config) {
+		cer.Snapshot = snapshotTicket(session, runner.SessionFolder, runner.Ticket, runner.InputCmd)
+	}
+	mark := activity.Begin(session)
+	defer activity.End(mark)
+	before := scanChanges(session)
+
+	startTicketMeta(runner, typ, session)
+	start := time.Now()
+	if len(runner.Steps) > 0 {
+		runBatch(ctx, session, runner, full, cer)
+	} else {
+		step, err := runStep(ctx, session, runner, runner.InputCmd, runner.Stdin, full)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to prepare command: %v", err)
+			logger.Print(msg)
+			return nil, fmt.Errorf("%s", msg)
+		}
+		cer.Output = step.Output
+		cer.ExitCode = step.ExitCode
+		cer.OutputBytes = step.OutputBytes
+		cer.Truncated = step.Truncated
+	}
+	cer.Duration = time.Since(start).String()
+	// Flush the full output so the diff below sees all of it
+	if err := full.Close(); err != nil {
+		logger.Printf("Failed to store the output of ticket %d: %v", runner.Ticket, err)
+	}
+
+	if before != nil {
+		after := scanChanges(session)
+		shared := activity.Overlapped(mark)
+		changes := diffSnapshots(before, after)
+		cer.FileChangeCount = len(changes)
+		if len(changes) > maxFileChanges {
+			changes = changes[:maxFileChanges]
+		}
+		cer.FileChanges = changes
+		cer.FileScan = fileScanComplete
+		if before.Truncated || after.Truncated {
+			cer.FileScan = fmt.Sprintf("only the first %d entries were scanned", changeScanEntries)
+		}
+		if shared {
+			if cer.FileScan == fileScanComplete {
+				cer.FileScan = fileScanShared
+			} else {
+				cer.FileScan += ", " + fileScanShared
+			}
+		}
+	}
+	if cer.Truncated {
+		cer.Next = fmt.Sprintf("This is your result. The output was truncated, page through the full %d bytes at %s. You can now issue your next command to /shell", cer.OutputBytes, OutputLink(session, runner.Ticket))
+	}
+	if runner.RerunOf > 0 {
+		cer.Diff = outputDiff(session, runner.RerunOf, runner.Ticket, runner.HeadBytes, runner.TailBytes)
+	}
+	if len(runner.Artifacts) > 0 {
+		cer.Artifacts = captureArtifacts(session, runner)
+	}
+	if cer.Sandbox == sandboxLandlock && cer.ExitCode != 0 && strings.Contains(cer.Output+stepOutputs(cer.Steps), "Permission denied") {
+		cer.Warning = landlockWarning(session, runner.Config)
+	}
+	if workspaceQuota > 0 {
+		if used, err := workspaceUsage(session); err == nil {
+			cer.WorkspaceBytes = used
+			cer.WorkspaceQuota = workspaceQuota
+			if used > workspaceQuota {
+				warning := fmt.Sprintf("The workspace holds %s, over its quota of %s. Remove files from it: uploads, file writes and edits are refused until it is back under quota.", formatSize(used), formatSize(workspaceQuota))
+				if cer.Warning != "" {
+					warning = cer.Warning + "\n\n" + warning
+				}
+				cer.Warning = warning
+			}
+		}
 	}
-	// Write the output to the file
-	result := makePlainCer(cer)
-	if _, err := file.WriteString(result); err != nil {
-		logger.Printf("Failed to write to file %s: %v", outputFile, err)
+	status := finishedStatus(cer)
+	if ctx.Err() == context.DeadlineExceeded {
+		status = ticketTimedOut
+		warning := fmt.Sprintf("The command was killed when it reached the ticket timeout of %s. Start long-running commands with /jobs/start instead.", ticketTimeout)
+		if cer.Warning != "" {
+			warning = cer.Warning + "\n\n" + warning
+		}
+		cer.Warning = warning
 	}
+	cer.Status = strings.ToUpper(status)
+
+	// Write the result to the ticket
+	writeTicket(session, runner.Ticket, makePlainCer(cer))
+	finishTicketMeta(cer, status)
 
 	return cer, nil
 }
 
+// Execute one shell command, appending its full output to full. The error
+// is only set when the command could not be prepared at all.
+func runStep(ctx context.Context, session string, runner *Runnner, input string, stdin []byte, full io.Writer) (*StepResult, error) {
+	// Execute the command using a shell to preserve quotes and complex syntax
+	cmd, err := buildCommand(ctx, session, runner, input)
+	if err != nil {
+		return nil, err
+	}
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	capture := newCappedOutput(full, runner.HeadBytes, runner.TailBytes, outputDiskBytes)
+	cmd.Stdout = capture
+	cmd.Stderr = capture
+
+	start := time.Now()
+	err = cmd.Start()
+	if err == nil {
+		pid := cmd.Process.Pid
+		updateTicketMeta(session, runner.Ticket, func(meta *TicketMeta) { meta.PID = pid })
+		err = cmd.Wait()
+	}
+	step := &StepResult{
+		Input:      input,
+		Status:     stepSucceeded,
+		ExitCode:   exitCode(err),
+		Duration:   time.Since(start).String(),
+		StdinBytes: len(stdin),
+	}
+	if err != nil {
+		step.Status = stepFailed
+		// Failures that never produced an exit status would otherwise be silent
+		if _, ok := err.(*exec.ExitError); !ok {
+			fmt.Fprintf(capture, "\n%v\n", err)
+		}
+		msg := fmt.Sprintf("Command execution failed : %s : %v", capture.String(), err)
+		logger.Print(msg)
+	}
+	step.Output = capture.String()
+	step.OutputBytes = capture.Total()
+	step.Truncated = capture.Truncated()
+	return step, nil
+}
+
+// Run each step of a batch in order, stopping at the first failure unless
+// the batch asked to continue
+func runBatch(ctx context.Context, session string, runner *Runnner, full io.Writer, cer *CmdResults) {
+	failed := false
+	for i, input := range runner.Steps {
+		if failed && !runner.ContinueOnError {
+			cer.Steps = append(cer.Steps, StepResult{Step: i + 1, Input: input, Status: stepSkipped})
+			continue
+		}
+
+		stdin := runner.Stdin
+		if i < len(runner.StepStdin) && runner.StepStdin[i] != nil {
+			stdin = runner.StepStdin[i]
+		}
+		fmt.Fprintf(full, "=== STEP %d ===\n", i+1)
+		step, err := runStep(ctx, session, runner, input, stdin, full)
+		if err != nil {
+			step = &StepResult{
+				Input:    input,
+				Status:   stepFailed,
+				ExitCode: -1,
+				Output:   fmt.Sprintf("Failed to prepare command: %v", err),
+			}
+		}
+		step.Step = i + 1
+		cer.Steps = append(cer.Steps, *step)
+		cer.OutputBytes += step.OutputBytes
+		cer.Truncated = cer.Truncated || step.Truncated
+
+		if step.Status == stepFailed && !failed {
+			failed = true
+			cer.ExitCode = step.ExitCode
+		}
+	}
+}
+
+// Exit status of a finished command, -1 when it never exited normally
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// Split a batch into steps. A JSON array of strings is used as is, anything
+// else is treated as one command per non-empty line.
+func parseBatch(batch string) ([]string, [][]byte, error) {
+	trimmed := strings.TrimSpace(batch)
+	steps := make([]string, 0)
+	var stdins [][]byte
+	if strings.HasPrefix(trimmed, "[") {
+		// Steps are strings, or objects when they come with their own stdin
+		var raw []json.RawMessage
+		if err := json.Unmarshal([]byte(trimmed), &raw); err != nil {
+			return nil, nil, fmt.Errorf("batch is not a JSON array: %v", err)
+		}
+		for i, item := range raw {
+			var step struct {
+				Cmd      string `json:"cmd"`
+				B64Stdin string `json:"b64stdin"`
+			}
+			if err := json.Unmarshal(item, &step.Cmd); err != nil {
+				if err := json.Unmarshal(item, &step); err != nil {
+					return nil, nil, fmt.Errorf("batch step %d is neither a string nor an object with 'cmd' and 'b64stdin'", i+1)
+				}
+			}
+			var stdin []byte
+			if step.B64Stdin != "" {
+				var err error
+				if stdin, err = base64.StdEncoding.DecodeString(step.B64Stdin); err != nil {
+					return nil, nil, fmt.Errorf("batch step %d has an invalid b64stdin: %v", i+1, err)
+				}
+				if stdins == nil {
+					stdins = make([][]byte, len(raw))
+				}
+				stdins[i] = stdin
+			}
+			steps = append(steps, step.Cmd)
+		}
+	} else {
+		for _, line := range strings.Split(trimmed, "\n") {
+			if strings.TrimSpace(line) != "" {
+				steps = append(steps, line)
+			}
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil, nil, fmt.Errorf("batch has no steps")
+	}
+	if len(steps) > maxBatchSteps {
+		return nil, nil, fmt.Errorf("batch has %d steps, the limit is %d", len(steps), maxBatchSteps)
+	}
+	for i, step := range steps {
+		if strings.TrimSpace(step) == "" {
+			return nil, nil, fmt.Errorf("batch step %d is empty", i+1)
+		}
+	}
+	return steps, stdins, nil
+}
+
+func stepOutputs(steps []StepResult) string {
+	var b strings.Builder
+	for _, step := range steps {
+		b.WriteString(step.Output)
+	}
+	return b.String()
+}
+
+// Run a ticket, recording preparation failures in the ticket file so an
+// asynchronous caller polling the callback still learns what went wrong
+func runTicket(w http.ResponseWriter, r *http.Request, forest *Runnner, typ string, session string) (*CmdResults, error) {
+	cer, err := runner(w, r, forest, typ, session)
+	if err != nil {
+		writeTicket(session, forest.Ticket, fmt.Sprintf("Failed to execute command: %v\n", err))
+		finishTicketMeta(&CmdResults{Type: typ, Session: session, Ticket: forest.Ticket, ExitCode: -1}, ticketFailed)
+	}
+	return cer, err
+}
+
+// Write the text of a ticket, which marks it as done for the LLM
+func writeTicket(session string, ticket int, content string) {
+	if err := store.WriteTicket(session, ticket, []byte(content)); err != nil {
+		logger.Printf("Failed to write ticket %d of session %s: %v", ticket, session, err)
+	}
+}
+
+// Lifecycle of a ticket as recorded in its sidecar
+const (
+	ticketQueued    = "queued" // Also while waiting for the tickets in after
+	ticketRunning   = "running"
+	ticketSucceeded = "succeeded"
+	ticketFailed    = "failed"
+	ticketTimedOut  = "timed_out"
+	ticketCancelled = "cancelled"
+
+	shellInterpreter = "/bin/bash"
+	ticketTimeout    = 5 * time.Minute // Commands still running after this are killed
+)
+
+// TicketMeta is the NN.json sidecar of a ticket. NN.ticket holds what the
+// LLM reads once the ticket is done, the sidecar tracks it from the moment
+// it is allocated.
+type TicketMeta struct {
+	Ticket       int        `json:"ticket"`
+	Type         string     `json:"type,omitempty"`
+	Status       string     `json:"status"`
+	Reason       string     `json:"reason,omitempty"` // Why a ticket was cancelled
+	Created      time.Time  `json:"created"`
+	Started      *time.Time `json:"started,omitempty"`
+	Ended        *time.Time `json:"ended,omitempty"`
+	PID          int        `json:"pid,omitempty"` // Of the last command started
+	ExitCode     *int       `json:"exit_code,omitempty"`
+	KeyID        string     `json:"key_id"`
+	ClientIP     string     `json:"client_ip,omitempty"`
+	ForwardedFor string     `json:"forwarded_for,omitempty"`
+	Interpreter  string     `json:"interpreter,omitempty"`
+	Cwd          string     `json:"cwd,omitempty"`
+	RunAs        string     `json:"run_as,omitempty"`
+	Elevated     bool       `json:"elevated,omitempty"`
+	Sandbox      string     `json:"sandbox,omitempty"`
+	Input        string     `json:"input,omitempty"`
+	B64Input     string     `json:"b64_input,omitempty"`
+	Steps        []string   `json:"steps,omitempty"` // Of a batch, whose step stdin stays in B64Input
+	StdinBytes   int        `json:"stdin_bytes,omitempty"`
+	OutputBytes  int64      `json:"output_bytes"`
+	StoredBytes  int64      `json:"stored_bytes"` // Of the full output kept in NN.output
+	Truncated    bool       `json:"truncated,omitempty"`
+}
+
+// Sidecars are read, changed and written back under one lock
+var ticketMetaMu sync.Mutex
+
+// Change a ticket's sidecar. Tickets from before sidecars existed have
+// none and are left alone.
+func updateTicketMeta(session string, ticket int, change func(meta *TicketMeta)) {
+	ticketMetaMu.Lock()
+	defer ticketMetaMu.Unlock()
+	meta, err := store.LoadMeta(session, ticket)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Printf("Failed to load metadata of ticket %d of session %s: %v", ticket, session, err)
+		}
+		return
+	}
+	change(meta)
+	if err := store.SaveMeta(session, meta); err != nil {
+		logger.Printf("Failed to save metadata of ticket %d of session %s: %v", ticket, session, err)
+	}
+}
+
+// Mark a ticket as running in the session workspace
+func startTicketMeta(runner *Runnner, typ string, session string) {
+	now := time.Now()
+	updateTicketMeta(session, runner.Ticket, func(meta *TicketMeta) {
+		meta.Type = typ
+		meta.Status = ticketRunning
+		meta.Started = &now
+		meta.Interpreter = shellInterpreter
+		meta.Cwd = sessionWorkspace(session)
+		meta.StdinBytes = len(runner.Stdin)
+	})
+}
+
+// Status of a finished ticket from its exit code
+func finishedStatus(cer *CmdResults) string {
+	if cer.ExitCode == 0 {
+		return ticketSucceeded
+	}
+	return ticketFailed
+}
+
+// Record how a ticket ended in its sidecar
+func finishTicketMeta(cer *CmdResults, status string) {
+	now := time.Now()
+	_, stored, _ := store.ReadOutput(cer.Session, cer.Ticket, 0, 0)
+	updateTicketMeta(cer.Session, cer.Ticket, func(meta *TicketMeta) {
+		meta.Type = cer.Type
+		meta.Status = status
+		if meta.Started == nil {
+			meta.Started = &now
+		}
+		meta.Ended = &now
+		exitCode := cer.ExitCode
+		meta.ExitCode = &exitCode
+		meta.OutputBytes = cer.OutputBytes
+		meta.StoredBytes = stored
+		meta.Truncated = cer.Truncated
+		if status == ticketCancelled {
+			meta.Reason = cer.Output
+		}
+	})
+}
+
+// Tickets that were queued or running when the server stopped will never
+// finish, so mark them cancelled and say so in their ticket file
+func initTickets() {
+	sessions, err := store.Sessions()
+	if err != nil {
+		logger.Printf("Failed to list sessions: %v", err)
+	}
+	for _, session := range sessions {
+		tickets, err := store.Tickets(session)
+		if err != nil {
+			logger.Printf("Failed to list tickets of session %s: %v", session, err)
+			continue
+		}
+		for _, ticket := range tickets {
+			meta, err := store.LoadMeta(session, ticket)
+			if err != nil || (meta.Status != ticketQueued && meta.Status != ticketRunning) {
+				continue
+			}
+			now := time.Now()
+			meta.Status = ticketCancelled
+			meta.Reason = "The server stopped before the ticket finished"
+			meta.Ended = &now
+			if err := store.SaveMeta(session, meta); err != nil {
+				logger.Printf("Failed to save metadata of ticket %d of session %s: %v", ticket, session, err)
+			}
+			if content, err := store.ReadTicket(session, ticket); err == nil && len(content) == 0 {
+				writeTicket(session, ticket, fmt.Sprintf("Ticket %d was cancelled because the server stopped before it finished. Its command may have run in part, check its effects before running it again.\n", ticket))
+			}
+			logger.Printf("CANCELLED: %s : %d : %s", session, ticket, meta.Reason)
+		}
+	}
+}
+
+// cappedOutput writes a command's full output to disk while keeping only
+// the first head and last tail bytes in memory
+type cappedOutput struct {
+	mu       sync.Mutex
+	disk     io.Writer
+	diskCap  int64
+	head     []byte
+	headCap  int
+	tail     []byte // ring buffer once full
+	tailCap  int
+	tailNext int
+	total    int64
+}
+
+func newCappedOutput(disk io.Writer, headCap, tailCap int, diskCap int64) *cappedOutput {
+	return &cappedOutput{disk: disk, diskCap: diskCap, headCap: headCap, tailCap: tailCap}
+}
+
+func (c *cappedOutput) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.disk != nil && c.total < c.diskCap {
+		chunk := p
+		if int64(len(chunk)) > c.diskCap-c.total {
+			chunk = chunk[:c.diskCap-c.total]
+		}
+		if _, err := c.disk.Write(chunk); err != nil {
+			logger.Printf("Failed to write full output: %v", err)
+			c.disk = nil
+		}
+	}
+	c.total += int64(len(p))
+
+	rest := p
+	if room := c.headCap - len(c.head); room > 0 {
+		if room > len(rest) {
+			room = len(rest)
+		}
+		c.head = append(c.head, rest[:room]...)
+		rest = rest[room:]
+	}
+	if c.tailCap == 0 || len(rest) == 0 {
+		return len(p), nil
+	}
+	if len(rest) >= c.tailCap {
+		c.tail = append(c.tail[:0], rest[len(rest)-c.tailCap:]...)
+		c.tailNext = 0
+		return len(p), nil
+	}
+	for _, b := range rest {
+		if len(c.tail) < c.tailCap {
+			c.tail = append(c.tail, b)
+			continue
+		}
+		c.tail[c.tailNext] = b
+		c.tailNext = (c.tailNext + 1) % c.tailCap
+	}
+	return len(p), nil
+}
+
+// Total is the number of bytes the command wrote
+func (c *cappedOutput) Total() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+// Truncated reports whether bytes were dropped between head and tail
+func (c *cappedOutput) Truncated() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total > int64(len(c.head)+len(c.tail))
+}
+
+// String joins head and tail with a marker counting the dropped bytes
+func (c *cappedOutput) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tail := append(append([]byte{}, c.tail[c.tailNext:]...), c.tail[:c.tailNext]...)
+	dropped := c.total - int64(len(c.head)+len(tail))
+	if dropped <= 0 {
+		return string(c.head) + string(tail)
+	}
+	return fmt.Sprintf("%s\n[... %d bytes truncated ...]\n%s", c.head, dropped, tail)
+}
+
+// Path of the stdin a ticket was given, kept so /rerun can feed it again
+func ticketStdinPath(sessionFolder string, ticket int) string {
+	return filepath.Join(sessionFolder, fmt.Sprintf("%02d.stdin", ticket))
+}
+
+// Read the stdin of a request from b64stdin or the body of a POST
+func requestStdin(r *http.Request) ([]byte, error) {
+	return requestData(r, "b64stdin")
+}
+
+// Read data sent base64-encoded in param or as the body of a POST, at most
+// STDIN_MAX_BYTES of it. Returns nil when neither was sent.
+func requestData(r *http.Request, param string) ([]byte, error) {
+	b64Data := r.URL.Query().Get(param)
+	if r.Method != http.MethodPost {
+		if b64Data == "" {
+			return nil, nil
+		}
+		data, err := base64.StdEncoding.DecodeString(b64Data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode '%s': %v", param, err)
+		}
+		if len(data) > maxStdinBytes {
+			return nil, fmt.Errorf("'%s' is larger than %d bytes", param, maxStdinBytes)
+		}
+		return data, nil
+	}
+	if b64Data != "" {
+		return nil, fmt.Errorf("Use either '%s' or a POST body, not both", param)
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(maxStdinBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read request body: %v", err)
+	}
+	if len(data) > maxStdinBytes {
+		return nil, fmt.Errorf("Request body is larger than %d bytes", maxStdinBytes)
+	}
+	return data, nil
+}
+
+// Path of the untruncated output kept next to a ticket
+func ticketOutputPath(sessionFolder string, ticket int) string {
+	return filepath.Join(sessionFolder, fmt.Sprintf("%02d.output", ticket))
+}
+
+// Read a non-negative integer query parameter, falling back to def when absent
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	return n, nil
+}
+
+// Read the 'head' and 'tail' output caps of a ticket, defaulting to
+// OUTPUT_HEAD_BYTES and OUTPUT_TAIL_BYTES. Larger values are clamped, the
+// ticket holds both in memory while it runs.
+func queryOutputCaps(r *http.Request) (int, int, error) {
+	head, err := queryInt(r, "head", outputHeadBytes)
+	if err != nil {
+		return 0, 0, err
+	}
+	tail, err := queryInt(r, "tail", outputTailBytes)
+	if err != nil {
+		return 0, 0, err
+	}
+	return min(head, maxOutputKeepBytes), min(tail, maxOutputKeepBytes), nil
+}
+
+// Build the command for a ticket, applying the session's user and sandbox
+func buildCommand(ctx context.Context, session string, runner *Runnner, input string) (*exec.Cmd, error) {
+	cmd := exec.CommandContext(ctx, shellInterpreter, "-c", input) // Use "cmd" /C on Windows if needed
+
+	// Commands start in the session workspace, not the server's own directory
+	workspace, err := ensureWorkspace(session, runner.Identity)
+	if err != nil {
+		return nil, err
+	}
+	switch sessionSandbox(runner.Config) {
+	case sandboxNamespace, sandboxLandlock:
+		// Only elevated tickets, which may do anything anyway, run as root inside
+		if runner.Identity == nil && !runner.Elevated && sandboxNeedsIdentity(sessionSandbox(runner.Config)) {
+			return nil, fmt.Errorf("the %s sandbox needs RUN_AS, the command would run as root inside it", sessionSandbox(runner.Config))
+		}
+		if runner.Identity != nil {
+			cmd.Env = identityEnv(runner.Identity)
+		}
+		spec := &sandboxSpec{
+			Workspace: workspace,
+			Identity:  runner.Identity,
+		}
+		if sessionSandbox(runner.Config) == sandboxNamespace {
+			spec.Namespaces = true
+			spec.Hostname = "llmass"
+			spec.Network = sessionNetwork(runner.Config) == "host"
+			spec.Hide = sandboxHiddenPaths()
+		} else {
+			readOnly, err := landlockReadRoots("/", sandboxHiddenPaths())
+			if err != nil {
+				return nil, err
+			}
+			readWrite := append([]string{workspace, "/dev/null"}, landlockRW...)
+			spec.Landlock = &landlockSpec{
+				ReadOnly:  readOnly,
+				ReadWrite: append(readWrite, runner.Config.ReadWrite...),
+			}
+		}
+		if err := applySandbox(cmd, spec); err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	}
+
+	if runner.Identity != nil {
+		if err := applyIdentity(cmd, runner.Identity); err != nil {
+			return nil, fmt.Errorf("failed to run as %s: %v", runner.Identity.User, err)
+		}
+	}
+	cmd.Dir = workspace
+	return cmd, nil
+}
+
 func historyHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	if r.Method != http.MethodGet {
@@ -515,64 +1939,55 @@ func historyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Check if session is provided in query parameters
 	session := r.URL.Query().Get("session")
-	if session == "" {
+	if !validSession(session) {
 		writePlainMessage(w, errSessionMessage)
 		return
 	}
 
 	// Check if session exists
-	sessionPath := filepath.Join(sessionsDir, session)
-	if _, err := os.Stat(sessionPath); os.IsNotExist(err) {
+	if exists, _ := store.SessionExists(session); !exists {
 		msg := fmt.Sprintf("Session %s does not exist", session)
 		writePlainMessage(w, msg)
 		return
 	}
 
-	// Read all ticket files in the session
-	files, err := os.ReadDir(sessionPath)
+	// Read all tickets of the session, in ticket order
+	tickets, err := store.Tickets(session)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to read session directory: %v", err)
+		msg := fmt.Sprintf("Failed to read session tickets: %v", err)
 		writePlainMessage(w, msg)
 		return
 	}
 
-	// Sort files by ticket number
-	tickets := make([]string, 0)
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".ticket" {
-			tickets = append(tickets, file.Name())
-		}
-	}
-
 	if len(tickets) == 0 {
 		msg := fmt.Sprintf("No tickets found for session %s", session)
 		writePlainMessage(w, msg)
 		return
 	}
 
-	// Sort tickets numerically
-	sort.Slice(tickets, func(i, j int) bool {
-		numI, _ := strconv.Atoi(strings.TrimSuffix(tickets[i], ".ticket"))
-		numJ, _ := strconv.Atoi(strings.TrimSuffix(tickets[j], ".ticket"))
-		return numI < numJ
-	})
-
 	fmt.Fprintf(w, "HELLO LLM, HERE IS YOUR COMMAND HISTORY:\n\n")
 
 	// Display content of all tickets with clear separation
-	for _, ticket := range tickets {
-		ticketNum := strings.TrimSuffix(ticket, ".ticket")
-		fmt.Fprintf(w, "--- TICKET %s ---\n", ticketNum)
+	for _, num := range tickets {
+		ticketNum := fmt.Sprintf("%02d", num)
+		status, _, _ := ticketStatus(session, num)
+		if status != "" {
+			fmt.Fprintf(w, "--- TICKET %s (%s) ---\n", ticketNum, status)
+		} else {
+			fmt.Fprintf(w, "--- TICKET %s ---\n", ticketNum)
+		}
 
-		content, err := os.ReadFile(filepath.Join(sessionPath, ticket))
+		content, err := store.ReadTicket(session, num)
 		if err != nil {
-			logger.Printf("Failed to read ticket %s: %v", ticket, err)
+			logger.Printf("Failed to read ticket %d: %v", num, err)
 			fmt.Fprintf(w, "Error reading ticket: %v\n\n", err)
 			continue
 		}
 
 		if len(content) > 0 {
 			fmt.Fprintf(w, "%s\n\n", content)
+		} else if status != "" {
+			fmt.Fprintf(w, "[No result yet, check %s]\n\n", Callback(session, num))
 		} else {
 			fmt.Fprintf(w, "[Empty ticket]\n\n")
 		}
@@ -804,14 +2219,47 @@ func sessionHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get the name parameter
 	nameParam := r.URL.Query().Get("name")
-	if nameParam == "" {
-		http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+	if !validSession(nameParam) {
+		http.Error(w, "Invalid or missing 'name' parameter, use 1 to 64 letters, digits, '_' or '-'", http.StatusBadRequest)
 		return
 	}
 
-	// Check if we should clear the session first
+	// Check if we should clear the session first, and its workspace with it
 	clearParam := r.URL.Query().Get("clear")
 	clearSession := clearParam == "true"
+	wipeWorkspace := r.URL.Query().Get("wipe") == "true"
+	if wipeWorkspace && !clearSession {
+		http.Error(w, "The 'wipe' parameter needs clear=true", http.StatusBadRequest)
+		return
+	}
+
+	// Optional sandbox settings stored in the session config
+	sandboxParam := r.URL.Query().Get("sandbox")
+	if sandboxParam != "" && !validSandbox(sandboxParam) {
+		http.Error(w, "Invalid 'sandbox' parameter, use 'none', 'namespace' or 'landlock'", http.StatusBadRequest)
+		return
+	}
+	if sandboxNeedsIdentity(sandboxParam) && runAsMode == "" {
+		http.Error(w, fmt.Sprintf("The %s sandbox needs the server to set RUN_AS", sandboxParam), http.StatusBadRequest)
+		return
+	}
+	networkParam := r.URL.Query().Get("network")
+	if networkParam != "" && networkParam != "host" && networkParam != "none" {
+		http.Error(w, "Invalid 'network' parameter, use 'host' or 'none'", http.StatusBadRequest)
+		return
+	}
+	snapshotsParam := r.URL.Query().Get("snapshots")
+	if snapshotsParam != "" && snapshotsParam != "true" && snapshotsParam != "false" {
+		http.Error(w, "Invalid 'snapshots' parameter, use 'true' or 'false'", http.StatusBadRequest)
+		return
+	}
+	rwParam := splitList(r.URL.Query().Get("rw"))
+	for _, path := range rwParam {
+		if !filepath.IsAbs(path) {
+			http.Error(w, "Invalid 'rw' parameter, paths must be absolute", http.StatusBadRequest)
+			return
+		}
+	}
 
 	sessionPath := filepath.Join(sessionsDir, nameParam)
 
@@ -821,24 +2269,5900 @@ func sessionHandler(w http.ResponseWriter, r *http.Request) {
 		sessionCmdCache.mu.Lock()
 		delete(sessionCmdCache.caches, nameParam)
 		sessionCmdCache.mu.Unlock()
+		scheduler.Drop(nameParam)
+		jobs.Drop(nameParam)
+		watches.Drop(nameParam)
 
-		// Remove directory
-		if err := os.RemoveAll(sessionPath); err != nil {
+		// Remove the session with its tickets
+		if err := store.DeleteSession(nameParam); err != nil {
 			logger.Printf("Failed to remove session directory for %s: %v", nameParam, err)
 			http.Error(w, "Failed to clear session", http.StatusInternalServerError)
 			return
 		}
+
+		// Only ever remove a direct child of the workspaces directory
+		workspace := sessionWorkspace(nameParam)
+		if wipeWorkspace && filepath.Dir(filepath.Clean(workspace)) == filepath.Clean(workspacesDir) {
+			if err := os.RemoveAll(workspace); err != nil {
+				logger.Printf("Failed to wipe workspace for %s: %v", nameParam, err)
+				http.Error(w, "Failed to wipe workspace", http.StatusInternalServerError)
+				return
+			}
+			logger.Printf("Wiped workspace %s", workspace)
+		}
 	}
 
-	// Create session directory if it doesn't exist
-	if err := os.MkdirAll(sessionPath, 0755); err != nil {
+	// Create session if it doesn't exist
+	if err := store.CreateSession(nameParam); err != nil {
 		logger.Printf("Failed to create session directory for %s: %v", nameParam, err)
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	// Initialize the session in the cache
-	sessionCmdCache.getSessionCache(nameParam)
-
-	writePlainMessage(w, fmt.Sprintf("Session '%s' created successfully", nameParam))
+	cfg, err := loadSessionConfig(sessionPath)
+	if err != nil {
+		logger.Printf("Failed to load config for session %s: %v", nameParam, err)
+		http.Error(w, "Failed to load session config", http.StatusInternalServerError)
+		return
+	}
+	if sandboxParam != "" || networkParam != "" || len(rwParam) > 0 || snapshotsParam != "" {
+		if sandboxParam != "" {
+			cfg.Sandbox = sandboxParam
+		}
+		if snapshotsParam != "" {
+			enabled := snapshotsParam == "true"
+			cfg.Snapshots = &enabled
+		}
+		if networkParam != "" {
+			cfg.Network = networkParam
+		}
+		if len(rwParam) > 0 {
+			cfg.ReadWrite = rwParam
+		}
+		if err := saveSessionConfig(sessionPath, cfg); err != nil {
+			logger.Printf("Failed to save config for session %s: %v", nameParam, err)
+			http.Error(w, "Failed to save session config", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Initialize the session in the cache
+	sessionCmdCache.getSessionCache(nameParam)
+
+	msg := fmt.Sprintf("Session '%s' created successfully", nameParam)
+	switch sessionSandbox(cfg) {
+	case sandboxNamespace:
+		msg += fmt.Sprintf(" (sandbox: %s, network: %s)", sessionSandbox(cfg), sessionNetwork(cfg))
+	case sandboxLandlock:
+		writable := append(append([]string{sessionWorkspace(nameParam)}, landlockRW...), cfg.ReadWrite...)
+		msg += fmt.Sprintf(" (sandbox: %s, writable: %s)", sessionSandbox(cfg), strings.Join(writable, ","))
+	}
+	if sessionSnapshots(cfg) {
+		msg += ", its workspace is snapshotted before each ticket"
+	}
+	writePlainMessage(w, msg)
+}
+
+// Load the session config, returning an empty config if none was saved yet
+func loadSessionConfig(sessionFolder string) (*SessionConfig, error) {
+	cfg := &SessionConfig{}
+	data, err := os.ReadFile(filepath.Join(sessionFolder, sessionConfigFile))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session config: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse session config: %v", err)
+	}
+	return cfg, nil
+}
+
+// Save the session config atomically so a crash never leaves half a file behind
+func saveSessionConfig(sessionFolder string, cfg *SessionConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode session config: %v", err)
+	}
+	tmp := filepath.Join(sessionFolder, sessionConfigFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write session config: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(sessionFolder, sessionConfigFile)); err != nil {
+		return fmt.Errorf("failed to save session config: %v", err)
+	}
+	return nil
+}
+
+// Look up a user by name or by a numeric uid:gid pair
+func lookupIdentity(entry string) (*Identity, error) {
+	if uidStr, gidStr, ok := strings.Cut(entry, ":"); ok {
+		uid, err := strconv.ParseUint(uidStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %q", uidStr)
+		}
+		gid, err := strconv.ParseUint(gidStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid %q", gidStr)
+		}
+		if uid == 0 {
+			return nil, fmt.Errorf("refusing to run sessions as uid 0")
+		}
+		id := &Identity{User: entry, UID: uint32(uid), GID: uint32(gid), Home: "/"}
+		if u, err := user.LookupId(uidStr); err == nil {
+			id.User = u.Username
+			id.Home = u.HomeDir
+		}
+		return id, nil
+	}
+
+	u, err := user.Lookup(entry)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has a non-numeric uid %q", entry, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s has a non-numeric gid %q", entry, u.Gid)
+	}
+	if uid == 0 {
+		return nil, fmt.Errorf("refusing to run sessions as uid 0")
+	}
+
+	id := &Identity{User: u.Username, UID: uint32(uid), GID: uint32(gid), Home: u.HomeDir}
+	if groupIds, err := u.GroupIds(); err == nil {
+		for _, g := range groupIds {
+			if n, err := strconv.ParseUint(g, 10, 32); err == nil && uint32(n) != id.GID {
+				id.Groups = append(id.Groups, uint32(n))
+			}
+		}
+	}
+	return id, nil
+}
+
+// Resolve the identity a session runs as, assigning one on first use.
+// A nil identity means commands run as the server's own user.
+func resolveIdentity(session string) (*Identity, error) {
+	if runAsMode == "" {
+		return nil, nil
+	}
+
+	identityMu.Lock()
+	defer identityMu.Unlock()
+
+	sessionFolder := filepath.Join(sessionsDir, session)
+	cfg, err := loadSessionConfig(sessionFolder)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RunAs != nil {
+		return cfg.RunAs, nil
+	}
+
+	var id *Identity
+	switch runAsMode {
+	case "pool":
+		id, err = leastUsedPoolIdentity()
+	case "session":
+		id, err = sessionUserIdentity(session)
+	default:
+		err = fmt.Errorf("unknown RUN_AS mode %q", runAsMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.RunAs = id
+	if err := saveSessionConfig(sessionFolder, cfg); err != nil {
+		return nil, err
+	}
+	logger.Printf("Session %s will run as %s (%d:%d)", session, id.User, id.UID, id.GID)
+	return id, nil
+}
+
+// Pick the pool entry currently assigned to the fewest sessions
+func leastUsedPoolIdentity() (*Identity, error) {
+	usage := make(map[uint32]int)
+	if entries, err := os.ReadDir(sessionsDir); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			cfg, err := loadSessionConfig(filepath.Join(sessionsDir, entry.Name()))
+			if err == nil && cfg.RunAs != nil {
+				usage[cfg.RunAs.UID]++
+			}
+		}
+	}
+
+	var best *Identity
+	for _, entry := range runAsPool {
+		id, err := lookupIdentity(entry)
+		if err != nil {
+			logger.Printf("Skipping RUN_AS_POOL entry %s: %v", entry, err)
+			continue
+		}
+		if best == nil || usage[id.UID] < usage[best.UID] {
+			best = id
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no usable users in RUN_AS_POOL")
+	}
+	return best, nil
+}
+
+// Session names become folder, workspace and user names, so they may not
+// hold separators, dots or anything else a path or useradd would interpret
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func validSession(session string) bool {
+	return sessionNamePattern.MatchString(session)
+}
+
+// Build a valid unix user name for the session, hashing long or unusual names
+func sessionUserName(session string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(session) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' || c == '-' {
+			b.WriteRune(c)
+		}
+	}
+	name := runAsPrefix + b.String()
+	if b.String() != session || len(name) > 32 {
+		h := fnv.New32a()
+		h.Write([]byte(session))
+		suffix := fmt.Sprintf("-%08x", h.Sum32())
+		if len(name) > 32-len(suffix) {
+			name = name[:32-len(suffix)]
+		}
+		name += suffix
+	}
+	return name
+}
+
+// Look up the per-session user, creating it with useradd when missing
+func sessionUserIdentity(session string) (*Identity, error) {
+	name := sessionUserName(session)
+	if id, err := lookupIdentity(name); err == nil {
+		return id, nil
+	}
+
+	cmd := exec.Command("useradd", "--system", "--user-group", "--no-create-home",
+		"--home-dir", "/nonexistent", "--shell", "/usr/sbin/nologin", name)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to create user %s: %v: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	logger.Printf("Created user %s for session %s", name, session)
+	return lookupIdentity(name)
+}
+
+// Elevation is only allowed for sessions listed in ELEVATE_SESSIONS
+func canElevate(session string) bool {
+	for _, allowed := range elevateSessions {
+		if allowed == "*" || allowed == session {
+			return true
+		}
+	}
+	return false
+}
+
+// Minimal environment for commands running as a session user, so secrets
+// such as HASH in the server's environment are not inherited
+func identityEnv(id *Identity) []string {
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	}
+	return []string{
+		"HOME=" + id.Home,
+		"USER=" + id.User,
+		"LOGNAME=" + id.User,
+		"SHELL=/bin/bash",
+		"PATH=" + path,
+		"LANG=" + os.Getenv("LANG"),
+		"TERM=dumb",
+	}
+}
+
+func validSandbox(mode string) bool {
+	return mode == sandboxNone || mode == sandboxNamespace || mode == sandboxLandlock
+}
+
+// The sandbox a session runs in, falling back to the SANDBOX default
+func sessionSandbox(cfg *SessionConfig) string {
+	if cfg != nil && cfg.Sandbox != "" {
+		return cfg.Sandbox
+	}
+	return sandboxMode
+}
+
+// Whether tickets of the session snapshot the workspace, falling back to SNAPSHOTS
+func sessionSnapshots(cfg *SessionConfig) bool {
+	if cfg != nil && cfg.Snapshots != nil {
+		return *cfg.Snapshots
+	}
+	return snapshotsDefault
+}
+
+// The network a sandboxed session gets, falling back to the SANDBOX_NETWORK default
+func sessionNetwork(cfg *SessionConfig) string {
+	if cfg != nil && cfg.Network != "" {
+		return cfg.Network
+	}
+	return sandboxNetwork
+}
+
+// Root inside a namespace sandbox can remount the read-only root and unmount
+// what hides the server, and root under Landlock can still read the server's
+// environment from /proc, so both only confine a session user
+func sandboxNeedsIdentity(mode string) bool {
+	return mode == sandboxNamespace || mode == sandboxLandlock
+}
+
+// Absolute path of the session's workspace directory
+func sessionWorkspace(session string) string {
+	return filepath.Join(workspacesDir, session)
+}
+
+// Resolve path to a file in the session's workspace. Relative paths start
+// at the workspace, absolute ones must lie in it, and symlinks may not lead
+// out of it.
+func workspaceFile(session string, path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("Invalid or missing 'path' parameter")
+	}
+	root, err := filepath.EvalSymlinks(sessionWorkspace(session))
+	if err != nil {
+		return "", fmt.Errorf("Session %s has no workspace yet", session)
+	}
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(sessionWorkspace(session), filepath.Clean(path))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return "", fmt.Errorf("Path %s is outside the session workspace %s", path, sessionWorkspace(session))
+		}
+		path = rel
+	}
+	full := filepath.Join(root, path)
+
+	// Resolve the part that exists, the rest is created later
+	existing, rest := full, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			full = filepath.Join(resolved, rest)
+			break
+		}
+		if existing == root || existing == filepath.Dir(existing) {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+	if full != root && !strings.HasPrefix(full, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("Path %s is outside the session workspace %s", path, sessionWorkspace(session))
+	}
+	return full, nil
+}
+
+// Open the session workspace as a root that every lookup stays beneath. A
+// path resolved by workspaceFile is only checked once, a command may swap one
+// of its directories for a symlink before the server opens it, so the server
+// does its own reads and writes through the root.
+func workspaceRoot(session string, full string) (*os.Root, string, error) {
+	base, err := filepath.EvalSymlinks(sessionWorkspace(session))
+	if err != nil {
+		return nil, "", fmt.Errorf("Session %s has no workspace yet", session)
+	}
+	rel, err := filepath.Rel(base, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, "", fmt.Errorf("Path %s is outside the session workspace %s", full, sessionWorkspace(session))
+	}
+	root, err := os.OpenRoot(base)
+	if err != nil {
+		return nil, "", err
+	}
+	return root, rel, nil
+}
+
+// Open a regular workspace file for reading. FIFOs and devices are refused
+// and the open never blocks, so a named pipe cannot hang the handler.
+func openWorkspaceFile(session string, full string) (*os.File, os.FileInfo, error) {
+	root, rel, err := workspaceRoot(session, full)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer root.Close()
+	if info, err := root.Lstat(rel); err != nil {
+		return nil, nil, err
+	} else if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+		return nil, nil, fmt.Errorf("%s is not a regular file", full)
+	}
+	file, err := root.OpenFile(rel, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, nil, fmt.Errorf("%s is not a regular file", full)
+	}
+	return file, info, nil
+}
+
+// Open rel below root for reading as long as it is a regular file and not a
+// symlink. The open never blocks, and the descriptor must be the very file
+// that was looked up, so swapping rel for a FIFO or a link in between fails.
+func openRegular(root *os.Root, rel string) (*os.File, os.FileInfo, error) {
+	before, err := root.Lstat(rel)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !before.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s is not a regular file", rel)
+	}
+	file, err := root.OpenFile(rel, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() || !os.SameFile(before, info) {
+		file.Close()
+		return nil, nil, fmt.Errorf("%s was replaced while it was opened", rel)
+	}
+	return file, info, nil
+}
+
+// Read a whole workspace file of at most max bytes, see openWorkspaceFile.
+// The size is checked on the opened file before anything is read.
+func readWorkspaceFile(session string, full string, max int64) ([]byte, error) {
+	file, info, err := openWorkspaceFile(session, full)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if info.Size() > max {
+		return nil, fmt.Errorf("%s is larger than %d bytes", full, max)
+	}
+	data, err := io.ReadAll(io.LimitReader(file, max+1))
+	if err == nil && int64(len(data)) > max {
+		return nil, fmt.Errorf("%s is larger than %d bytes", full, max)
+	}
+	return data, err
+}
+
+// Remove a workspace file without following a swapped directory out of it
+func removeWorkspaceFile(session string, full string) error {
+	defer activity.End(activity.Begin(session))
+	root, rel, err := workspaceRoot(session, full)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Remove(rel)
+}
+
+// Resolve a path to write in the session workspace, creating the workspace
+// for the user the request acts as. Elevated requests write as root.
+func workspaceTarget(session string, path string, elevated bool) (string, *Identity, error) {
+	runner, err := sessionRunner(session, elevated)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := ensureWorkspace(session, runner.Identity); err != nil {
+		return "", nil, err
+	}
+	full, err := workspaceFile(session, path)
+	if err != nil {
+		return "", nil, err
+	}
+	return full, runner.Identity, nil
+}
+
+// Read the octal 'mode' parameter. Without it an existing file keeps its
+// permissions and a new one gets 0644.
+func queryMode(r *http.Request, path string) (os.FileMode, error) {
+	value := r.URL.Query().Get("mode")
+	if value == "" {
+		if info, err := os.Stat(path); err == nil {
+			return info.Mode().Perm(), nil
+		}
+		return 0644, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid 'mode' parameter, use octal permissions such as 0644")
+	}
+	return os.FileMode(mode), nil
+}
+
+// Atomically replace a workspace file with data, owned by the session user
+func writeWorkspaceFile(session string, path string, data []byte, mode os.FileMode, id *Identity) error {
+	defer activity.End(activity.Begin(session))
+	root, rel, err := workspaceRoot(session, path)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if err := mkdirAllOwned(root, filepath.Dir(rel), id); err != nil {
+		return err
+	}
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(rel), ".llmass-"+hex.EncodeToString(raw))
+	file, err := root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer root.Remove(tmp)
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+	if err == nil && id != nil {
+		err = file.Chown(int(id.UID), int(id.GID))
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return root.Rename(tmp, rel)
+}
+
+// Like os.MkdirAll inside root, but the directories it creates belong to
+// the session user
+func mkdirAllOwned(root *os.Root, dir string, id *Identity) error {
+	if dir == "." {
+		return nil
+	}
+	if info, err := root.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := mkdirAllOwned(root, parent, id); err != nil {
+			return err
+		}
+	}
+	if err := root.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if id != nil {
+		return root.Lchown(dir, int(id.UID), int(id.GID))
+	}
+	return nil
+}
+
+// Bytes held by the files in the session workspace. Symlinks are not
+// followed, so only what the workspace itself stores is counted.
+func workspaceUsage(session string) (int64, error) {
+	var used int64
+	err := filepath.WalkDir(sessionWorkspace(session), func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				used += info.Size()
+			}
+		}
+		return nil
+	})
+	return used, err
+}
+
+// Refuse to write size bytes to path when that takes the workspace over
+// WORKSPACE_QUOTA. The file's current size is freed by the write.
+func checkQuota(session string, path string, size int64) error {
+	if workspaceQuota <= 0 {
+		return nil
+	}
+	used, err := workspaceUsage(session)
+	if err != nil {
+		return fmt.Errorf("Failed to measure the workspace: %v", err)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+		used -= info.Size()
+	}
+	if used+size > workspaceQuota {
+		return fmt.Errorf("Writing %s would take the workspace to %s, over its quota of %s. Remove files from it first.", formatSize(size), formatSize(used+size), formatSize(workspaceQuota))
+	}
+	return nil
+}
+
+// Create the session workspace and hand it to the session user. It is only
+// chowned while someone else owns it, e.g. after an elevated command created
+// it, and never through a symlink put in its place.
+func ensureWorkspace(session string, id *Identity) (string, error) {
+	if !validSession(session) {
+		return "", fmt.Errorf("invalid session name %q", session)
+	}
+	workspace := sessionWorkspace(session)
+	if err := os.MkdirAll(workspace, 0755); err != nil {
+		return "", fmt.Errorf("failed to create workspace: %v", err)
+	}
+	info, err := os.Lstat(workspace)
+	if err != nil {
+		return "", fmt.Errorf("failed to create workspace: %v", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("workspace %s is not a directory", workspace)
+	}
+	if id != nil && !ownedBy(info, id) {
+		if err := os.Lchown(workspace, int(id.UID), int(id.GID)); err != nil {
+			return "", fmt.Errorf("failed to chown workspace to %s: %v", id.User, err)
+		}
+	}
+	return workspace, nil
+}
+
+// Host paths masked inside sandboxes. The server's own directory holds .env
+// and the sessions of every other agent.
+func sandboxHiddenPaths() []string {
+	hidden := make([]string, 0, len(sandboxHide)+5)
+	if cwd, err := os.Getwd(); err == nil && cwd != "/" {
+		hidden = append(hidden, cwd)
+	}
+	if dir, err := filepath.Abs(sessionsDir); err == nil {
+		hidden = append(hidden, dir)
+	}
+	// The sqlite database may live outside both, along with its WAL files
+	if storageKind == storageSQLite && storagePath != "" {
+		if db, err := filepath.Abs(storagePath); err == nil {
+			hidden = append(hidden, db, db+"-wal", db+"-shm")
+		}
+	}
+	return append(hidden, sandboxHide...)
+}
+
+// Explain a failed landlocked command, since the kernel only reports EACCES
+func landlockWarning(session string, cfg *SessionConfig) string {
+	writable := append(append([]string{sessionWorkspace(session)}, landlockRW...), cfg.ReadWrite...)
+	return fmt.Sprintf("Permission denied while running under the session's Landlock ruleset. "+
+		"This session may only write to: %s. Everything else is read-only, and the server's own "+
+		"directories cannot be read. Write inside the workspace instead.", strings.Join(writable, ", "))
+}
+
+// Landlock can only grant access, so read access to everything except the
+// hidden paths is expressed as the siblings along the way down to each of them
+func landlockReadRoots(dir string, hidden []string) ([]string, error) {
+	contains := false
+	for _, h := range hidden {
+		if h == dir {
+			return nil, nil
+		}
+		if dir == "/" || strings.HasPrefix(h, dir+"/") {
+			contains = true
+		}
+	}
+	if !contains {
+		return []string{dir}, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", dir, err)
+	}
+	roots := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		sub, err := landlockReadRoots(filepath.Join(dir, entry.Name()), hidden)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, sub...)
+	}
+	return roots, nil
+}
+
+const (
+	statusQueued    = "QUEUED"
+	statusRunning   = "RUNNING"
+	statusWaiting   = "WAITING"
+	statusCancelled = "CANCELLED"
+	statusWatching  = "WATCHING"
+
+	onSuccess = "success"
+	onFailure = "failure"
+	onAlways  = "always"
+)
+
+// ticketJob is a ticket waiting for, or holding, a worker
+type ticketJob struct {
+	seq      uint64
+	session  string
+	ticket   int
+	parallel bool   // may run alongside the session's other tickets
+	after    []int  // tickets that must finish first
+	on       string // outcome of after required to run: success, failure or always
+	run      func()
+	cancel   func(reason string) // called instead of run when after ends with the wrong outcome
+	running  bool
+}
+
+// sessionQueue holds one session's queued tickets in ticket order
+type sessionQueue struct {
+	pending []*ticketJob
+	running int
+}
+
+// Index of the next pending ticket allowed to start, or -1. Serial tickets
+// only start once every earlier ticket has finished, parallel tickets only
+// need a free session worker.
+func (sq *sessionQueue) nextRunnable(maxSession int, ready func(*ticketJob) bool) int {
+	if sq.running >= maxSession {
+		return -1
+	}
+	for i, job := range sq.pending {
+		if job.parallel && ready(job) {
+			return i
+		}
+		if i == 0 && sq.running == 0 && ready(job) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Executor bounds how many tickets run at once, globally and per session,
+// and hands free workers to sessions round-robin so one busy session
+// cannot starve the others
+type Executor struct {
+	mu         sync.Mutex
+	maxWorkers int
+	maxSession int
+	running    int
+	seq        uint64
+	sessions   map[string]*sessionQueue
+	rotation   []string // sessions with pending tickets, in round-robin order
+	next       int      // rotation index that gets the next free worker
+	jobs       map[string]map[int]*ticketJob
+	// outcome reports whether a ticket the executor no longer tracks has
+	// finished and whether it succeeded
+	outcome func(session string, ticket int) (done bool, succeeded bool)
+}
+
+var executor *Executor
+
+// Initialize the worker pool
+func initExecutor(maxWorkers, maxSession int) {
+	executor = &Executor{
+		maxWorkers: maxWorkers,
+		maxSession: maxSession,
+		sessions:   make(map[string]*sessionQueue),
+		jobs:       make(map[string]map[int]*ticketJob),
+		outcome:    ticketOutcome,
+	}
+}
+
+// Submit queues a ticket, run is called once a worker is free. Unless
+// parallel is set the ticket waits for all earlier tickets of its session,
+// and it waits for its after tickets before running or being cancelled.
+func (e *Executor) Submit(job *ticketJob) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.seq++
+	job.seq = e.seq
+	session, ticket := job.session, job.ticket
+
+	sq, exists := e.sessions[session]
+	if !exists {
+		sq = &sessionQueue{}
+		e.sessions[session] = sq
+	}
+	if len(sq.pending) == 0 {
+		e.rotation = append(e.rotation, session)
+	}
+	// Concurrent submissions can arrive out of order, keep the queue in ticket order
+	pos := sort.Search(len(sq.pending), func(i int) bool { return sq.pending[i].ticket > ticket })
+	sq.pending = append(sq.pending, nil)
+	copy(sq.pending[pos+1:], sq.pending[pos:])
+	sq.pending[pos] = job
+
+	if e.jobs[session] == nil {
+		e.jobs[session] = make(map[int]*ticketJob)
+	}
+	e.jobs[session][ticket] = job
+
+	e.dispatch()
+}
+
+// Start queued tickets while workers are free. Callers must hold e.mu.
+func (e *Executor) dispatch() {
+	for e.cancelUnmet() {
+	}
+
+	for e.running < e.maxWorkers && len(e.rotation) > 0 {
+		started := false
+		for i := 0; i < len(e.rotation); i++ {
+			idx := (e.next + i) % len(e.rotation)
+			session := e.rotation[idx]
+			sq := e.sessions[session]
+			pick := sq.nextRunnable(e.maxSession, e.ready)
+			if pick < 0 {
+				continue
+			}
+
+			job := sq.pending[pick]
+			sq.pending = append(sq.pending[:pick], sq.pending[pick+1:]...)
+			if len(sq.pending) == 0 {
+				e.rotation = append(e.rotation[:idx], e.rotation[idx+1:]...)
+				e.next = idx
+			} else {
+				e.next = idx + 1
+			}
+			if len(e.rotation) > 0 {
+				e.next %= len(e.rotation)
+			} else {
+				e.next = 0
+			}
+
+			e.start(sq, job)
+			started = true
+			break
+		}
+		if !started {
+			return
+		}
+	}
+}
+
+// Whether every dependency of job has finished, and whether together they
+// satisfy its on condition. Callers must hold e.mu.
+func (e *Executor) dependencies(job *ticketJob) (done bool, satisfied bool, reason string) {
+	satisfied = true
+	for _, dep := range job.after {
+		if _, tracked := e.jobs[job.session][dep]; tracked {
+			return false, false, ""
+		}
+		depDone, succeeded := e.outcome(job.session, dep)
+		if !depDone {
+			return false, false, ""
+		}
+		switch {
+		case job.on == onSuccess && !succeeded:
+			satisfied = false
+			reason = fmt.Sprintf("Cancelled: ticket %d did not succeed and this ticket only runs on success", dep)
+		case job.on == onFailure && succeeded:
+			satisfied = false
+			reason = fmt.Sprintf("Cancelled: ticket %d succeeded and this ticket only runs on failure", dep)
+		}
+	}
+	return true, satisfied, reason
+}
+
+// Whether job may start as far as its dependencies are concerned
+func (e *Executor) ready(job *ticketJob) bool {
+	done, satisfied, _ := e.dependencies(job)
+	return done && satisfied
+}
+
+// Cancel pending tickets whose dependencies finished with the wrong outcome.
+// Returns true when something was cancelled, since that can decide other
+// tickets depending on it. Callers must hold e.mu.
+func (e *Executor) cancelUnmet() bool {
+	for session, sq := range e.sessions {
+		for i, job := range sq.pending {
+			if len(job.after) == 0 {
+				continue
+			}
+			done, satisfied, reason := e.dependencies(job)
+			if !done || satisfied {
+				continue
+			}
+
+			sq.pending = append(sq.pending[:i], sq.pending[i+1:]...)
+			if len(sq.pending) == 0 {
+				for idx, name := range e.rotation {
+					if name == session {
+						e.rotation = append(e.rotation[:idx], e.rotation[idx+1:]...)
+						break
+					}
+				}
+				if len(e.rotation) > 0 {
+					e.next %= len(e.rotation)
+				} else {
+					e.next = 0
+				}
+				if sq.running == 0 {
+					delete(e.sessions, session)
+				}
+			}
+			delete(e.jobs[session], job.ticket)
+			if len(e.jobs[session]) == 0 {
+				delete(e.jobs, session)
+			}
+			// The ticket file is written before its dependents are resolved
+			job.cancel(reason)
+			return true
+		}
+	}
+	return false
+}
+
+// Run the job on its own goroutine. Callers must hold e.mu.
+func (e *Executor) start(sq *sessionQueue, job *ticketJob) {
+	e.running++
+	sq.running++
+	job.running = true
+
+	go func() {
+		defer e.finish(sq, job)
+		job.run()
+	}()
+}
+
+// Poke re-checks pending tickets after something outside the pool, such as
+// a watch, finished
+func (e *Executor) Poke() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dispatch()
+}
+
+func (e *Executor) finish(sq *sessionQueue, job *ticketJob) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.running--
+	sq.running--
+	delete(e.jobs[job.session], job.ticket)
+	if len(e.jobs[job.session]) == 0 {
+		delete(e.jobs, job.session)
+	}
+	if sq.running == 0 && len(sq.pending) == 0 {
+		delete(e.sessions, job.session)
+	}
+	e.dispatch()
+}
+
+// State reports whether a ticket is QUEUED or RUNNING, and its queue position
+// when queued. Tickets the executor no longer tracks return an empty status.
+func (e *Executor) State(session string, ticket int) (string, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	job, exists := e.jobs[session][ticket]
+	if !exists {
+		return "", 0
+	}
+	if job.running {
+		return statusRunning, 0
+	}
+	if done, _, _ := e.dependencies(job); !done {
+		return statusWaiting, 0
+	}
+
+	// Ahead are the session's earlier tickets and older tickets of other sessions
+	position := 1
+	for name, sq := range e.sessions {
+		for _, other := range sq.pending {
+			if name == session && other.ticket < job.ticket {
+				position++
+			} else if name != session && other.seq < job.seq {
+				position++
+			}
+		}
+	}
+	return statusQueued, position
+}
+
+// Waiting lists the dependencies a ticket is still waiting for
+func (e *Executor) Waiting(session string, ticket int) []int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	waiting := make([]int, 0)
+	job, exists := e.jobs[session][ticket]
+	if !exists {
+		return waiting
+	}
+	for _, dep := range job.after {
+		if _, tracked := e.jobs[session][dep]; tracked {
+			waiting = append(waiting, dep)
+		} else if done, _ := e.outcome(session, dep); !done {
+			waiting = append(waiting, dep)
+		}
+	}
+	return waiting
+}
+
+// Queued is the number of tickets waiting for a worker
+func (e *Executor) Queued() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	queued := 0
+	for _, sq := range e.sessions {
+		queued += len(sq.pending)
+	}
+	return queued
+}
+
+// Outcome of a ticket the executor no longer tracks, read from its sidecar.
+// Only a final status counts as done; initTickets gives tickets left over
+// from a restart one.
+func ticketOutcome(session string, ticket int) (bool, bool) {
+	if watches != nil && watches.Active(session, ticket) {
+		return false, false
+	}
+	if meta, err := store.LoadMeta(session, ticket); err == nil {
+		switch meta.Status {
+		case ticketSucceeded:
+			return true, true
+		case ticketFailed, ticketTimedOut, ticketCancelled:
+			return true, false
+		}
+		// Still queued or running outside the pool, like an edit, a restore
+		// or a ticket about to be submitted
+		return false, false
+	}
+	// Without metadata there is no status to trust, the ticket text holds the
+	// agent's own input and output too
+	return true, false
+}
+
+// Parse a comma separated list of ticket numbers
+func parseTicketList(value string) ([]int, error) {
+	tickets := make([]int, 0)
+	for _, item := range splitList(value) {
+		ticket, err := strconv.Atoi(item)
+		if err != nil || ticket < 1 {
+			return nil, fmt.Errorf("%q is not a ticket number", item)
+		}
+		tickets = append(tickets, ticket)
+	}
+	return tickets, nil
+}
+
+func joinTickets(tickets []int) string {
+	parts := make([]string, 0, len(tickets))
+	for _, ticket := range tickets {
+		parts = append(parts, strconv.Itoa(ticket))
+	}
+	return strings.Join(parts, ",")
+}
+
+const (
+	schedulesFile    = "schedules.json"
+	minScheduleEvery = 10 * time.Second
+)
+
+// Schedule runs a command once at a time, on a fixed interval or on a cron
+// expression. Every run is a normal ticket of the session.
+type Schedule struct {
+	ID         int        `json:"id"`
+	Input      string     `json:"input"`
+	B64Input   string     `json:"b64input"`
+	At         *time.Time `json:"at,omitempty"`
+	Every      string     `json:"every,omitempty"`
+	Cron       string     `json:"cron,omitempty"`
+	Elevated   bool       `json:"elevated,omitempty"`
+	Paused     bool       `json:"paused,omitempty"`
+	Done       bool       `json:"done,omitempty"`
+	Created    time.Time  `json:"created"`
+	NextRun    time.Time  `json:"next_run"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastTicket int        `json:"last_ticket,omitempty"`
+	Runs       int        `json:"runs"`
+}
+
+// Compute the first run after now. One-shot schedules run once at At.
+func (sc *Schedule) next(now time.Time) (time.Time, error) {
+	switch {
+	case sc.At != nil:
+		return *sc.At, nil
+	case sc.Every != "":
+		every, err := time.ParseDuration(sc.Every)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(every), nil
+	default:
+		spec, err := parseCron(sc.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		next := spec.Next(now)
+		if next.IsZero() {
+			return next, fmt.Errorf("cron expression %q never matches", sc.Cron)
+		}
+		return next, nil
+	}
+}
+
+// Scheduler fires due schedules of all sessions and keeps them on disk in
+// each session folder so they survive a restart.
+type Scheduler struct {
+	mu       sync.Mutex
+	sessions map[string][]*Schedule
+}
+
+var scheduler *Scheduler
+
+// Load the schedules of every session and start firing them. Runs missed
+// while the server was down are caught up once.
+func initScheduler() {
+	scheduler = &Scheduler{sessions: make(map[string][]*Schedule)}
+	folders, err := filepath.Glob(filepath.Join(sessionsDir, "*", schedulesFile))
+	if err != nil {
+		logger.Printf("Failed to list schedules: %v", err)
+	}
+	for _, file := range folders {
+		session := filepath.Base(filepath.Dir(file))
+		schedules, err := loadSchedules(filepath.Dir(file))
+		if err != nil {
+			logger.Printf("Failed to load schedules for session %s: %v", session, err)
+			continue
+		}
+		scheduler.sessions[session] = schedules
+	}
+	go func() {
+		for now := range time.NewTicker(time.Second).C {
+			scheduler.tick(now)
+		}
+	}()
+}
+
+func loadSchedules(sessionFolder string) ([]*Schedule, error) {
+	data, err := os.ReadFile(filepath.Join(sessionFolder, schedulesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var schedules []*Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func saveSchedules(sessionFolder string, schedules []*Schedule) error {
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(sessionFolder, schedulesFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(sessionFolder, schedulesFile))
+}
+
+// Add a schedule to a session, assigning it the next free id
+func (s *Scheduler) Add(session string, sc *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schedules := s.sessions[session]
+	for _, existing := range schedules {
+		if existing.ID >= sc.ID {
+			sc.ID = existing.ID + 1
+		}
+	}
+	if sc.ID == 0 {
+		sc.ID = 1
+	}
+	schedules = append(schedules, sc)
+	if err := saveSchedules(filepath.Join(sessionsDir, session), schedules); err != nil {
+		return err
+	}
+	s.sessions[session] = schedules
+	return nil
+}
+
+// List a copy of the schedules of a session
+func (s *Scheduler) List(session string) []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Schedule, 0, len(s.sessions[session]))
+	for _, sc := range s.sessions[session] {
+		list = append(list, *sc)
+	}
+	return list
+}
+
+// Pause, resume or delete a schedule by id
+func (s *Scheduler) Update(session string, id int, action string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schedules := s.sessions[session]
+	for i, sc := range schedules {
+		if sc.ID != id {
+			continue
+		}
+		switch action {
+		case "pause":
+			sc.Paused = true
+		case "resume":
+			sc.Paused = false
+			// Resuming does not replay the runs missed while paused
+			if !sc.Done && sc.NextRun.Before(time.Now()) {
+				next, err := sc.next(time.Now())
+				if err != nil {
+					return err
+				}
+				if sc.At == nil {
+					sc.NextRun = next
+				}
+			}
+		case "delete":
+			schedules = append(schedules[:i:i], schedules[i+1:]...)
+		}
+		if err := saveSchedules(filepath.Join(sessionsDir, session), schedules); err != nil {
+			return err
+		}
+		s.sessions[session] = schedules
+		return nil
+	}
+	return fmt.Errorf("Schedule %d does not exist in session %s", id, session)
+}
+
+// Create, list, pause, resume and delete the schedules of a session
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+
+	switch action := strings.TrimPrefix(r.URL.Path, "/schedule"); action {
+	case "":
+		createSchedule(w, r, session)
+	case "/list":
+		listSchedules(w, session)
+	case "/pause", "/resume", "/delete":
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			writePlainMessage(w, "Invalid or missing 'id' parameter")
+			return
+		}
+		if err := scheduler.Update(session, id, action[1:]); err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		logger.Printf("SCHEDULE %s: %s : %d", strings.ToUpper(action[1:]), session, id)
+		writePlainMessage(w, fmt.Sprintf("Schedule %d of session %s: %sd", id, session, action[1:]))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func createSchedule(w http.ResponseWriter, r *http.Request, session string) {
+	b64CmdParam := r.URL.Query().Get("b64cmd")
+	cmdParam := r.URL.Query().Get("cmd")
+	inputCmd := cmdParam
+	if b64CmdParam != "" {
+		decodedBytes, err := base64.StdEncoding.DecodeString(b64CmdParam)
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to decode base64 command: %v", err))
+			return
+		}
+		inputCmd = string(decodedBytes)
+	} else {
+		b64CmdParam = base64.StdEncoding.EncodeToString([]byte(cmdParam))
+	}
+	if inputCmd == "" {
+		writePlainMessage(w, "Invalid or missing 'cmd' or 'b64cmd' parameter")
+		return
+	}
+
+	now := time.Now()
+	sc := &Schedule{
+		Input:    inputCmd,
+		B64Input: b64CmdParam,
+		Every:    r.URL.Query().Get("every"),
+		Cron:     r.URL.Query().Get("cron"),
+		Elevated: r.URL.Query().Get("elevate") == "true",
+		Created:  now,
+	}
+	at := r.URL.Query().Get("at")
+	set := 0
+	for _, v := range []string{at, sc.Every, sc.Cron} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		writePlainMessage(w, "Provide exactly one of 'at', 'every' or 'cron'")
+		return
+	}
+	if at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			writePlainMessage(w, "Invalid 'at' parameter, use RFC3339 like 2025-01-02T15:04:05Z")
+			return
+		}
+		sc.At = &t
+	}
+	if sc.Every != "" {
+		every, err := time.ParseDuration(sc.Every)
+		if err != nil || every < minScheduleEvery {
+			writePlainMessage(w, fmt.Sprintf("Invalid 'every' parameter, use a duration of at least %s like 10m", minScheduleEvery))
+			return
+		}
+	}
+	next, err := sc.next(now)
+	if err != nil {
+		writePlainMessage(w, fmt.Sprintf("Invalid 'cron' parameter: %v", err))
+		return
+	}
+	sc.NextRun = next
+
+	if sc.Elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+
+	if err := store.CreateSession(session); err != nil {
+		logger.Printf("Failed to create session %s: %v", session, err)
+		writePlainMessage(w, errServerMessage)
+		return
+	}
+	if err := scheduler.Add(session, sc); err != nil {
+		logger.Printf("Failed to save schedule for session %s: %v", session, err)
+		writePlainMessage(w, errServerMessage)
+		return
+	}
+	logger.Printf("SCHEDULE ADD: %s : %d : %s", session, sc.ID, inputCmd)
+	writePlainMessage(w, fmt.Sprintf("Schedule %d created in session %s, next run at %s. Each run creates a ticket, see %s", sc.ID, session, sc.NextRun.Format(time.RFC3339), fmt.Sprintf("%s/history?hash=%s&session=%s", fqdn, hashPassword, session)))
+}
+
+func listSchedules(w http.ResponseWriter, session string) {
+	schedules := scheduler.List(session)
+	if len(schedules) == 0 {
+		writePlainMessage(w, fmt.Sprintf("No schedules in session %s", session))
+		return
+	}
+	var sb strings.Builder
+	for _, sc := range schedules {
+		when := "every " + sc.Every
+		if sc.Cron != "" {
+			when = "cron " + sc.Cron
+		} else if sc.At != nil {
+			when = "at " + sc.At.Format(time.RFC3339)
+		}
+		state := "active"
+		if sc.Done {
+			state = "done"
+		} else if sc.Paused {
+			state = "paused"
+		}
+		fmt.Fprintf(&sb, "--- SCHEDULE %d ---\n", sc.ID)
+		fmt.Fprintf(&sb, "STATE: %s\n", state)
+		fmt.Fprintf(&sb, "WHEN: %s\n", when)
+		if !sc.Done {
+			fmt.Fprintf(&sb, "NEXT_RUN: %s\n", sc.NextRun.Format(time.RFC3339))
+		}
+		fmt.Fprintf(&sb, "RUNS: %d\n", sc.Runs)
+		if sc.LastRun != nil {
+			fmt.Fprintf(&sb, "LAST_RUN: %s\n", sc.LastRun.Format(time.RFC3339))
+			fmt.Fprintf(&sb, "LAST_TICKET: %s\n", Callback(session, sc.LastTicket))
+		}
+		if sc.Elevated {
+			fmt.Fprintf(&sb, "ELEVATED: true\n")
+		}
+		fmt.Fprintf(&sb, "INPUT: %s\n\n", sc.Input)
+	}
+	writePlainMessage(w, sb.String())
+}
+
+// Forget the schedules of a cleared session
+func (s *Scheduler) Drop(session string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session)
+}
+
+// Submit a ticket for every schedule that is due at now
+// A due schedule, copied so its ticket can be created without s.mu
+type dueSchedule struct {
+	session string
+	sc      Schedule
+	ticket  int
+}
+
+// Advance the due schedules under s.mu, then create and submit their tickets
+// once it is released, since that goes through storage and the executor
+func (s *Scheduler) tick(now time.Time) {
+	var due []*dueSchedule
+	s.mu.Lock()
+	for session, schedules := range s.sessions {
+		changed := false
+		for _, sc := range schedules {
+			if sc.Paused || sc.Done || sc.NextRun.After(now) {
+				continue
+			}
+			changed = true
+			if s.advance(session, sc, now) {
+				due = append(due, &dueSchedule{session: session, sc: *sc})
+			}
+		}
+		if changed {
+			if err := saveSchedules(filepath.Join(sessionsDir, session), schedules); err != nil {
+				logger.Printf("Failed to save schedules for session %s: %v", session, err)
+			}
+		}
+	}
+	s.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	for _, d := range due {
+		d.ticket = s.fire(d.session, &d.sc)
+	}
+	s.recordRuns(due, now)
+}
+
+// Move a due schedule to its next run, reporting whether it should fire now
+func (s *Scheduler) advance(session string, sc *Schedule, now time.Time) bool {
+	if sc.At != nil {
+		sc.Done = true
+		return true
+	}
+	next, err := sc.next(now)
+	if err != nil {
+		logger.Printf("Pausing schedule %d of session %s: %v", sc.ID, session, err)
+		sc.Paused = true
+		return false
+	}
+	sc.NextRun = next
+	return true
+}
+
+// Create and submit the ticket of a schedule, returning 0 when none was made
+func (s *Scheduler) fire(session string, sc *Schedule) int {
+	// The session or the schedule may have been deleted since the tick
+	if !s.exists(session, sc.ID) {
+		return 0
+	}
+	if sc.Elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for schedule %d of session %s", sc.ID, session)
+		return 0
+	}
+	forest, err := newTicket(nil, session, sc.Input, sc.B64Input, sc.Elevated)
+	if err != nil {
+		logger.Printf("Failed to create ticket for schedule %d of session %s: %v", sc.ID, session, err)
+		return 0
+	}
+	logger.Printf("SCHEDULED: %s : %s : %s\n", session, sc.Input, Callback(session, forest.Ticket))
+	submitTicket(nil, nil, forest, "scheduled", session)
+	return forest.Ticket
+}
+
+func (s *Scheduler) exists(session string, id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sc := range s.sessions[session] {
+		if sc.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Record the tickets fired schedules got, unless they were deleted meanwhile
+func (s *Scheduler) recordRuns(due []*dueSchedule, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := make(map[string]bool)
+	for _, d := range due {
+		if d.ticket == 0 {
+			continue
+		}
+		for _, sc := range s.sessions[d.session] {
+			if sc.ID == d.sc.ID {
+				sc.LastRun = &now
+				sc.LastTicket = d.ticket
+				sc.Runs++
+				changed[d.session] = true
+			}
+		}
+	}
+	for session := range changed {
+		if err := saveSchedules(filepath.Join(sessionsDir, session), s.sessions[session]); err != nil {
+			logger.Printf("Failed to save schedules for session %s: %v", session, err)
+		}
+	}
+}
+
+// cronSpec holds the allowed values of each of the five cron fields as bit sets
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// Parse a five field cron expression: minute hour day-of-month month
+// day-of-week. Fields accept *, values, ranges, lists and /steps.
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression needs 5 fields, got %d", len(fields))
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron field %q: %v", field, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is both 0 and 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSpec{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first minute after t matching the spec. Like cron, a
+// restricted day-of-month and day-of-week match when either does.
+func (c *cronSpec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every valid expression matches within a few years
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		dom := c.dom&(1<<uint(t.Day())) != 0
+		dow := c.dow&(1<<uint(t.Weekday())) != 0
+		day := dom && dow
+		if !c.domAny && !c.dowAny {
+			day = dom || dow
+		}
+		if !day {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) != 0 {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+const (
+	jobsFolder   = "jobs"
+	jobRunning   = "RUNNING"
+	jobExited    = "EXITED"
+	jobStopped   = "STOPPED"
+	jobLost      = "LOST"
+	jobStopGrace = 5 * time.Second
+
+	// Jobs run outside the worker pool and are not bound to the ticket
+	// timeout, so how many may run at once is capped
+	maxJobs        = 64
+	maxSessionJobs = 8
+)
+
+// Job is a background command of a session. Unlike a ticket it is not
+// bound to the ticket timeout and keeps running until it exits or is
+// stopped. Its output goes to a rotating log next to its metadata in the
+// session's jobs folder.
+type Job struct {
+	ID         int        `json:"id"`
+	Input      string     `json:"input"`
+	B64Input   string     `json:"b64input"`
+	Status     string     `json:"status"`
+	PID        int        `json:"pid"`
+	RunAs      string     `json:"run_as,omitempty"`
+	Elevated   bool       `json:"elevated,omitempty"`
+	Sandbox    string     `json:"sandbox"`
+	Started    time.Time  `json:"started"`
+	Ended      *time.Time `json:"ended,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	LogStart   int64      `json:"log_start"`
+	PrevStart  int64      `json:"prev_start"`
+	LogBytes   int64      `json:"log_bytes"`
+	StdinBytes int        `json:"stdin_bytes,omitempty"`
+
+	folder   string
+	cmd      *exec.Cmd
+	log      *rotatingLog
+	stopping bool
+	done     chan struct{}
+	activity *activityMark
+}
+
+func (j *Job) metaPath() string {
+	return filepath.Join(j.folder, fmt.Sprintf("%d.json", j.ID))
+}
+
+func (j *Job) logPath() string {
+	return filepath.Join(j.folder, fmt.Sprintf("%d.log", j.ID))
+}
+
+func (j *Job) save() error {
+	if j.log != nil {
+		j.LogStart, j.PrevStart, j.LogBytes = j.log.Offsets()
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.metaPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.metaPath())
+}
+
+// JobManager tracks the background jobs of all sessions
+type JobManager struct {
+	mu       sync.Mutex
+	sessions map[string]map[int]*Job
+}
+
+var jobs *JobManager
+
+// Load the jobs recorded on disk. Jobs that were running when the server
+// stopped can no longer be managed and are marked lost.
+func initJobs() {
+	jobs = &JobManager{sessions: make(map[string]map[int]*Job)}
+	files, err := filepath.Glob(filepath.Join(sessionsDir, "*", jobsFolder, "*.json"))
+	if err != nil {
+		logger.Printf("Failed to list jobs: %v", err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			logger.Printf("Failed to load job %s: %v", file, err)
+			continue
+		}
+		job := &Job{}
+		if err := json.Unmarshal(data, job); err != nil {
+			logger.Printf("Failed to load job %s: %v", file, err)
+			continue
+		}
+		job.folder = filepath.Dir(file)
+		if job.Status == jobRunning {
+			job.Status = jobLost
+			// Offsets are only saved on start, so rebuild them from the logs
+			if info, err := os.Stat(job.logPath() + ".1"); err == nil {
+				job.LogStart = job.PrevStart + info.Size()
+			}
+			job.LogBytes = job.LogStart
+			if info, err := os.Stat(job.logPath()); err == nil {
+				job.LogBytes += info.Size()
+			}
+			if err := job.save(); err != nil {
+				logger.Printf("Failed to save job %s: %v", file, err)
+			}
+		}
+		session := filepath.Base(filepath.Dir(job.folder))
+		if jobs.sessions[session] == nil {
+			jobs.sessions[session] = make(map[int]*Job)
+		}
+		jobs.sessions[session][job.ID] = job
+	}
+}
+
+// Start input as a background job of the session described by runner.
+// Nothing is started once the session or the server runs as many jobs as
+// allowed.
+func (m *JobManager) Start(session string, runner *Runnner, input string, b64Input string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	running, total := 0, 0
+	for name, sessionJobs := range m.sessions {
+		for _, job := range sessionJobs {
+			if job.Status != jobRunning {
+				continue
+			}
+			total++
+			if name == session {
+				running++
+			}
+		}
+	}
+	if running >= maxSessionJobs {
+		return nil, fmt.Errorf("Session %s already runs %d jobs, stop one with /jobs/stop first", session, maxSessionJobs)
+	}
+	if total >= maxJobs {
+		return nil, fmt.Errorf("The server already runs %d jobs, try again later", maxJobs)
+	}
+
+	folder := filepath.Join(runner.SessionFolder, jobsFolder)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	id := 1
+	for existing := range m.sessions[session] {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+	job := &Job{
+		ID:         id,
+		Input:      input,
+		B64Input:   b64Input,
+		Status:     jobRunning,
+		Elevated:   runner.Elevated,
+		Sandbox:    sessionSandbox(runner.Config),
+		Started:    time.Now(),
+		StdinBytes: len(runner.Stdin),
+		folder:     folder,
+		done:       make(chan struct{}),
+	}
+	if runner.Identity != nil {
+		job.RunAs = runner.Identity.User
+	}
+
+	cmd, err := buildCommand(context.Background(), session, runner, input)
+	if err != nil {
+		return nil, err
+	}
+	log, err := newRotatingLog(job.logPath(), jobLogBytes)
+	if err != nil {
+		return nil, err
+	}
+	setProcessGroup(cmd)
+	if runner.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(runner.Stdin)
+	}
+	cmd.Stdout = log
+	cmd.Stderr = log
+	if err := cmd.Start(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	job.cmd = cmd
+	job.log = log
+	job.PID = cmd.Process.Pid
+	if err := job.save(); err != nil {
+		logger.Printf("Failed to save job %d of session %s: %v", id, session, err)
+	}
+	if m.sessions[session] == nil {
+		m.sessions[session] = make(map[int]*Job)
+	}
+	m.sessions[session][id] = job
+
+	job.activity = activity.Begin(session)
+	go m.wait(session, job)
+	return job, nil
+}
+
+// Record how a job ended once its process and output are done
+func (m *JobManager) wait(session string, job *Job) {
+	err := job.cmd.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	code := exitCode(err)
+	job.Ended = &now
+	job.ExitCode = &code
+	job.Status = jobExited
+	if job.stopping {
+		job.Status = jobStopped
+	}
+	if err := job.save(); err != nil {
+		logger.Printf("Failed to save job %d of session %s: %v", job.ID, session, err)
+	}
+	job.log.Close()
+	activity.End(job.activity)
+	logger.Printf("JOB %s: %s : %d : exit %d", job.Status, session, job.ID, code)
+	close(job.done)
+}
+
+// Find a job of a session
+func (m *JobManager) Get(session string, id int) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.sessions[session][id]
+	if !ok {
+		return nil, fmt.Errorf("Job %d does not exist in session %s", id, session)
+	}
+	return job, nil
+}
+
+// Stop a running job and its children, killing them if they ignore SIGTERM
+func (m *JobManager) Stop(session string, id int) error {
+	job, err := m.Get(session, id)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if job.Status != jobRunning {
+		m.mu.Unlock()
+		return nil
+	}
+	job.stopping = true
+	m.mu.Unlock()
+
+	if err := signalProcessGroup(job.cmd, syscall.SIGTERM); err != nil {
+		logger.Printf("Failed to stop job %d of session %s: %v", id, session, err)
+	}
+	select {
+	case <-job.done:
+	case <-time.After(jobStopGrace):
+		if err := signalProcessGroup(job.cmd, syscall.SIGKILL); err != nil {
+			logger.Printf("Failed to kill job %d of session %s: %v", id, session, err)
+		}
+		<-job.done
+	}
+	return nil
+}
+
+// Stop the running jobs of a session and forget them
+func (m *JobManager) Drop(session string) {
+	m.mu.Lock()
+	var ids []int
+	for id, job := range m.sessions[session] {
+		if job.Status == jobRunning {
+			ids = append(ids, id)
+		}
+	}
+	m.mu.Unlock()
+	for _, id := range ids {
+		if err := m.Stop(session, id); err != nil {
+			logger.Print(err)
+		}
+	}
+	m.mu.Lock()
+	delete(m.sessions, session)
+	m.mu.Unlock()
+}
+
+// Describe the jobs of a session, or only the given one
+func (m *JobManager) Describe(session string, only ...int) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []int
+	if len(only) > 0 {
+		ids = only
+	} else {
+		for id := range m.sessions[session] {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+	}
+	var sb strings.Builder
+	for _, id := range ids {
+		job, ok := m.sessions[session][id]
+		if !ok {
+			continue
+		}
+		if job.log != nil {
+			_, _, job.LogBytes = job.log.Offsets()
+		}
+		fmt.Fprintf(&sb, "--- JOB %d ---\n", job.ID)
+		fmt.Fprintf(&sb, "STATUS: %s\n", job.Status)
+		fmt.Fprintf(&sb, "PID: %d\n", job.PID)
+		if job.RunAs != "" {
+			fmt.Fprintf(&sb, "RUN_AS: %s\n", job.RunAs)
+		}
+		if job.Elevated {
+			fmt.Fprintf(&sb, "ELEVATED: true\n")
+		}
+		fmt.Fprintf(&sb, "SANDBOX: %s\n", job.Sandbox)
+		fmt.Fprintf(&sb, "STARTED: %s\n", job.Started.Format(time.RFC3339))
+		if job.Ended != nil {
+			fmt.Fprintf(&sb, "ENDED: %s\n", job.Ended.Format(time.RFC3339))
+		}
+		if job.ExitCode != nil {
+			fmt.Fprintf(&sb, "EXIT_CODE: %d\n", *job.ExitCode)
+		}
+		if job.StdinBytes > 0 {
+			fmt.Fprintf(&sb, "STDIN_BYTES: %d\n", job.StdinBytes)
+		}
+		fmt.Fprintf(&sb, "OUTPUT_BYTES: %d\n", job.LogBytes)
+		fmt.Fprintf(&sb, "TAIL: %s\n", jobLink("tail", session, job.ID))
+		if job.Status == jobRunning {
+			fmt.Fprintf(&sb, "STOP: %s\n", jobLink("stop", session, job.ID))
+		}
+		fmt.Fprintf(&sb, "INPUT: %s\n\n", job.Input)
+	}
+	return sb.String()
+}
+
+// Read up to limit bytes of a job's output starting at offset. Output that
+// was rotated away is skipped and reported through from.
+func (m *JobManager) Tail(session string, id int, offset int64, limit int) (data []byte, from int64, total int64, status string, err error) {
+	job, err := m.Get(session, id)
+	if err != nil {
+		return nil, 0, 0, "", err
+	}
+	m.mu.Lock()
+	status = job.Status
+	log := job.log
+	start, prevStart, total := job.LogStart, job.PrevStart, job.LogBytes
+	m.mu.Unlock()
+	if log != nil {
+		data, from, total, err = log.ReadAt(offset, limit)
+		return data, from, total, status, err
+	}
+	data, from, err = readRotated(job.logPath(), start, prevStart, total, offset, limit)
+	return data, from, total, status, err
+}
+
+// Start, list, tail and stop the background jobs of a session
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	switch action {
+	case "start":
+		startJob(w, r, session)
+		return
+	case "list":
+		list := jobs.Describe(session)
+		if list == "" {
+			list = fmt.Sprintf("No jobs in session %s", session)
+		}
+		writePlainMessage(w, list)
+		return
+	case "tail", "stop":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		writePlainMessage(w, "Invalid or missing 'id' parameter")
+		return
+	}
+	if action == "stop" {
+		if err := jobs.Stop(session, id); err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		logger.Printf("JOB STOP: %s : %d", session, id)
+		writePlainMessage(w, jobs.Describe(session, id))
+		return
+	}
+
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+	limit, err := queryInt(r, "limit", outputHeadBytes)
+	if err != nil || limit == 0 {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+	data, from, total, status, err := jobs.Tail(session, id, int64(offset), limit)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+
+	res := fmt.Sprintf("HELLO LLM, HERE IS THE REQUESTED JOB OUTPUT!\n\n")
+	res += fmt.Sprintf("SESSION: %s\n\n", session)
+	res += fmt.Sprintf("JOB: %d\n\n", id)
+	res += fmt.Sprintf("STATUS: %s\n\n", status)
+	res += fmt.Sprintf("TOTAL_BYTES: %d\n\n", total)
+	if from > int64(offset) {
+		res += fmt.Sprintf("SKIPPED: %d bytes were rotated out of the log\n\n", from-int64(offset))
+	}
+	next := from + int64(len(data))
+	res += fmt.Sprintf("RANGE: %d-%d\n\n", from, next)
+	if next < total || status == jobRunning {
+		res += fmt.Sprintf("NEXT:\n\n%s&offset=%d&limit=%d\n\n", jobLink("tail", session, id), next, limit)
+	}
+	res += fmt.Sprintf("OUTPUT:\n\n%s\n\n", data)
+	fmt.Fprint(w, res)
+}
+
+func startJob(w http.ResponseWriter, r *http.Request, session string) {
+	b64CmdParam := r.URL.Query().Get("b64cmd")
+	cmdParam := r.URL.Query().Get("cmd")
+	inputCmd := cmdParam
+	if b64CmdParam != "" {
+		decodedBytes, err := base64.StdEncoding.DecodeString(b64CmdParam)
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to decode base64 command: %v", err))
+			return
+		}
+		inputCmd = string(decodedBytes)
+	} else {
+		b64CmdParam = base64.StdEncoding.EncodeToString([]byte(cmdParam))
+	}
+	if inputCmd == "" {
+		writePlainMessage(w, "Invalid or missing 'cmd' or 'b64cmd' parameter")
+		return
+	}
+
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+	stdin, err := requestStdin(r)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	runner, err := sessionRunner(session, elevated)
+	if err != nil {
+		logger.Print(err)
+		writePlainMessage(w, err.Error())
+		return
+	}
+	runner.Stdin = stdin
+	job, err := jobs.Start(session, runner, inputCmd, b64CmdParam)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to start job: %v", err)
+		logger.Print(msg)
+		writePlainMessage(w, msg)
+		return
+	}
+	logger.Printf("JOB START: %s : %d : %s", session, job.ID, inputCmd)
+
+	res := fmt.Sprintf("HELLO LLM, YOUR JOB IS RUNNING IN THE BACKGROUND!\n\n")
+	res += fmt.Sprintf("Poll TAIL with the offset from its NEXT link to follow the output and call STOP when you are done with it.\n\n")
+	res += jobs.Describe(session, job.ID)
+	fmt.Fprint(w, res)
+}
+
+func jobLink(action string, session string, id int) string {
+	return fmt.Sprintf("%s/jobs/%s?hash=%s&session=%s&id=%d", fqdn, action, hashPassword, session, id)
+}
+
+// rotatingLog writes to path and moves it to path.1 once it holds max
+// bytes, so a job keeps at most twice max bytes on disk. Offsets count
+// every byte ever written so readers can resume where they left off.
+type rotatingLog struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	max       int64
+	size      int64
+	start     int64 // Offset of the first byte in path
+	prevStart int64 // Offset of the first byte in path.1
+	total     int64
+}
+
+func newRotatingLog(path string, max int64) (*rotatingLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(path + ".1")
+	return &rotatingLog{path: path, file: file, max: max}, nil
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		if l.size >= l.max {
+			if err := l.rotate(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if room := l.max - l.size; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := l.file.Write(chunk)
+		written += n
+		l.size += int64(n)
+		l.total += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (l *rotatingLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.prevStart = l.start
+	l.start = l.total
+	l.size = 0
+	return nil
+}
+
+func (l *rotatingLog) Offsets() (start, prevStart, total int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.start, l.prevStart, l.total
+}
+
+// ReadAt reads from the log while holding off rotation
+func (l *rotatingLog) ReadAt(offset int64, limit int) ([]byte, int64, int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data, from, err := readRotated(l.path, l.start, l.prevStart, l.total, offset, limit)
+	return data, from, l.total, err
+}
+
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Read a range of a rotated log given its offsets. The returned from is
+// where the data really starts when offset was already rotated away.
+func readRotated(path string, start, prevStart, total, offset int64, limit int) ([]byte, int64, error) {
+	earliest := start
+	if _, err := os.Stat(path + ".1"); err == nil {
+		earliest = prevStart
+	}
+	if offset < earliest {
+		offset = earliest
+	}
+	if offset > total {
+		offset = total
+	}
+	var data []byte
+	for from := offset; len(data) < limit && from < total; from = offset + int64(len(data)) {
+		file, base, end := path, start, total
+		if from < start {
+			file, base, end = path+".1", prevStart, start
+		}
+		buf := make([]byte, min64(int64(limit-len(data)), end-from))
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, offset, err
+		}
+		n, err := f.ReadAt(buf, from-base)
+		f.Close()
+		data = append(data, buf[:n]...)
+		if err != nil && err != io.EOF {
+			return nil, offset, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return data, offset, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+const (
+	diffContext  = 3
+	maxDiffBytes = 4 * 1024 * 1024
+	maxDiffEdits = 1000
+)
+
+// Re-run an earlier ticket as a new ticket, optionally editing its command
+func rerunHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+
+	original, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+	if err != nil {
+		writePlainMessage(w, errTicketMessage)
+		return
+	}
+
+	sessionFolder := filepath.Join(sessionsDir, session)
+	if exists, _ := store.SessionExists(session); !exists {
+		writePlainMessage(w, fmt.Sprintf("Session %s does not exist", session))
+		return
+	}
+
+	inputCmd, b64Input, steps, stepStdin, err := ticketInput(session, original)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	// The original stdin is fed again unless new stdin is given
+	stdin, err := requestStdin(r)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	if stdin == nil {
+		stdin, err = os.ReadFile(ticketStdinPath(sessionFolder, original))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Printf("Failed to read stdin of ticket %d: %v", original, err)
+		}
+	}
+
+	// Either replace the command outright or edit it with find and replace
+	if b64CmdParam := r.URL.Query().Get("b64cmd"); b64CmdParam != "" {
+		decodedBytes, err := base64.StdEncoding.DecodeString(b64CmdParam)
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to decode base64 command: %v", err))
+			return
+		}
+		inputCmd, b64Input, steps, stepStdin = string(decodedBytes), b64CmdParam, nil, nil
+	} else if b64FindParam := r.URL.Query().Get("b64find"); b64FindParam != "" {
+		find, err := base64.StdEncoding.DecodeString(b64FindParam)
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to decode 'b64find': %v", err))
+			return
+		}
+		replace, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("b64replace"))
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to decode 'b64replace': %v", err))
+			return
+		}
+		if !strings.Contains(inputCmd, string(find)) {
+			writePlainMessage(w, fmt.Sprintf("'b64find' does not occur in the input of ticket %d", original))
+			return
+		}
+		inputCmd = strings.ReplaceAll(inputCmd, string(find), string(replace))
+		b64Input = base64.StdEncoding.EncodeToString([]byte(inputCmd))
+		if steps != nil {
+			batch := make([]interface{}, len(steps))
+			for i := range steps {
+				steps[i] = strings.ReplaceAll(steps[i], string(find), string(replace))
+				batch[i] = steps[i]
+				if i < len(stepStdin) && stepStdin[i] != nil {
+					batch[i] = map[string]string{"cmd": steps[i], "b64stdin": base64.StdEncoding.EncodeToString(stepStdin[i])}
+				}
+			}
+			encoded, _ := json.Marshal(batch)
+			b64Input = base64.StdEncoding.EncodeToString(encoded)
+		}
+	}
+
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+	headBytes, tailBytes, err := queryOutputCaps(r)
+	if err != nil {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+
+	artifacts, err := queryArtifacts(r)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+
+	// Re-runs are explicit, so they skip the duplicate command cache
+	forest, err := newTicket(r, session, inputCmd, b64Input, elevated)
+	if err != nil {
+		logger.Print(err)
+		writePlainMessage(w, err.Error())
+		return
+	}
+	forest.HeadBytes = headBytes
+	forest.TailBytes = tailBytes
+	forest.Steps = steps
+	forest.StepStdin = stepStdin
+	forest.Stdin = stdin
+	forest.ContinueOnError = r.URL.Query().Get("onerror") == "continue"
+	forest.Artifacts = artifacts
+	forest.RerunOf = original
+	forest.CmdSubmission.RerunOf = original
+
+	logger.Printf("RERUN: %s : %d : %s : %s\n", session, original, inputCmd, Callback(session, forest.Ticket))
+	dispatchTicket(w, r, forest, session)
+}
+
+// Recover the command a finished ticket ran from its sidecar. Batches
+// return their steps and the stdin of each step as well.
+func ticketInput(session string, ticket int) (string, string, []string, [][]byte, error) {
+	meta, err := store.LoadMeta(session, ticket)
+	if err != nil {
+		if _, err := store.ReadTicket(session, ticket); os.IsNotExist(err) {
+			return "", "", nil, nil, fmt.Errorf("Ticket %d does not exist", ticket)
+		}
+		return "", "", nil, nil, fmt.Errorf("Ticket %d has no recorded input", ticket)
+	}
+	switch meta.Status {
+	case ticketQueued, ticketRunning:
+		return "", "", nil, nil, fmt.Errorf("Ticket %d has not finished yet", ticket)
+	}
+	switch meta.Type {
+	case "edit":
+		return "", "", nil, nil, fmt.Errorf("Ticket %d is a file edit, undo it with /file/revert instead", ticket)
+	case "restore":
+		return "", "", nil, nil, fmt.Errorf("Ticket %d is a snapshot restore, undo it with /snapshot/restore instead", ticket)
+	}
+
+	if len(meta.Steps) > 0 {
+		var stepStdin [][]byte
+		if decoded, err := base64.StdEncoding.DecodeString(meta.B64Input); err == nil {
+			if _, stdins, err := parseBatch(string(decoded)); err == nil && len(stdins) == len(meta.Steps) {
+				stepStdin = stdins
+			}
+		}
+		return strings.Join(meta.Steps, "\n"), meta.B64Input, meta.Steps, stepStdin, nil
+	}
+	if meta.Input == "" {
+		return "", "", nil, nil, fmt.Errorf("Ticket %d has no recorded input", ticket)
+	}
+	return meta.Input, meta.B64Input, nil, nil, nil
+}
+
+// Diff the full output of ticket against the one of original, keeping the
+// head and tail of a long diff
+func outputDiff(session string, original, ticket int, headBytes, tailBytes int) string {
+	var outputs [2]string
+	for i, t := range []int{original, ticket} {
+		data, size, err := store.ReadOutput(session, t, 0, maxDiffBytes)
+		if os.IsNotExist(err) {
+			return fmt.Sprintf("No full output for ticket %d to diff", t)
+		}
+		if err != nil {
+			return fmt.Sprintf("Failed to read the output of ticket %d: %v", t, err)
+		}
+		if size > maxDiffBytes {
+			return fmt.Sprintf("Not diffed, the output of ticket %d is larger than %d bytes", t, maxDiffBytes)
+		}
+		outputs[i] = string(data)
+	}
+	diff := unifiedDiff(fmt.Sprintf("ticket %d", original), fmt.Sprintf("ticket %d", ticket), outputs[0], outputs[1])
+	if diff == "" {
+		return fmt.Sprintf("Output is identical to ticket %d", original)
+	}
+	capture := newCappedOutput(nil, headBytes, tailBytes, 0)
+	capture.Write([]byte(diff))
+	return capture.String()
+}
+
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// Produce a unified diff of two texts by line, or "" when they are equal
+func unifiedDiff(aName, bName, a, b string) string {
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	// Line numbers of each diff line in a and b, counted from 1
+	aAt := make([]int, len(lines)+1)
+	bAt := make([]int, len(lines)+1)
+	aAt[0], bAt[0] = 1, 1
+	for i, l := range lines {
+		aAt[i+1], bAt[i+1] = aAt[i], bAt[i]
+		if l.op != '+' {
+			aAt[i+1]++
+		}
+		if l.op != '-' {
+			bAt[i+1]++
+		}
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(lines); i++ {
+		if lines[i].op == ' ' {
+			continue
+		}
+		// Grow the hunk while changes are close enough to share context
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(lines) && j <= end+2*diffContext; j++ {
+			if lines[j].op != ' ' {
+				end = j
+			}
+		}
+		stop := end + diffContext + 1
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aAt[start], aAt[stop]), hunkRange(bAt[start], bAt[stop]))
+		for _, l := range lines[start:stop] {
+			fmt.Fprintf(&sb, "%c%s\n", l.op, l.text)
+		}
+		i = stop - 1
+	}
+	return sb.String()
+}
+
+// Format the lines from up to stop as a hunk range. Like diff, an empty
+// range names the line before it.
+func hunkRange(from, stop int) string {
+	if stop == from {
+		return fmt.Sprintf("%d,0", from-1)
+	}
+	return fmt.Sprintf("%d,%d", from, stop-from)
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Diff two slices of lines, trimming their common prefix and suffix before
+// running Myers' algorithm on the rest
+func diffLines(a, b []string) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []diffLine
+	for _, l := range a[:prefix] {
+		lines = append(lines, diffLine{' ', l})
+	}
+	lines = append(lines, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, l := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{' ', l})
+	}
+	return lines
+}
+
+// Find the shortest edit script between a and b. Past maxDiffEdits the
+// whole of a is reported as replaced by b.
+func myersDiff(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > maxDiffEdits {
+		limit = maxDiffEdits
+	}
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(trace, a, b, offset)
+			}
+		}
+	}
+
+	var lines []diffLine
+	for _, l := range a {
+		lines = append(lines, diffLine{'-', l})
+	}
+	for _, l := range b {
+		lines = append(lines, diffLine{'+', l})
+	}
+	return lines
+}
+
+func myersBacktrack(trace [][]int, a, b []string, offset int) []diffLine {
+	var reversed []diffLine
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, diffLine{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			reversed = append(reversed, diffLine{'+', b[y-1]})
+		} else {
+			reversed = append(reversed, diffLine{'-', a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, diffLine{' ', a[x-1]})
+		x--
+		y--
+	}
+
+	lines := make([]diffLine, len(reversed))
+	for i, l := range reversed {
+		lines[len(reversed)-1-i] = l
+	}
+	return lines
+}
+
+const (
+	defaultWatchInterval = 10 * time.Second
+	minWatchInterval     = time.Second
+	defaultWatchMax      = 10 * time.Minute
+	maxWatchMax          = 24 * time.Hour
+	maxWatchChanges      = 20
+	watchUntilExit0      = "exit0"
+	watchUntilMatch      = "match"
+	watchTimedOutCode    = 124
+
+	// Watches and waits each hold a goroutine and run commands outside the
+	// worker pool, so how many may run at once is capped
+	maxWatches        = 64
+	maxSessionWatches = 8
+)
+
+// Watch re-runs a command of a session at an interval and records the runs
+// whose output changed in a single ticket. Watches run outside the worker
+// pool, like jobs.
+type Watch struct {
+	Runner   *Runnner
+	Session  string
+	Interval time.Duration
+	Max      time.Duration
+	Until    string
+	Match    *regexp.Regexp
+}
+
+// WatchManager tracks the tickets of all sessions that run in the
+// background outside the worker pool, such as watches and waits
+type WatchManager struct {
+	mu       sync.Mutex
+	sessions map[string]map[int]chan struct{}
+}
+
+var watches *WatchManager
+
+func initWatches() {
+	watches = &WatchManager{sessions: make(map[string]map[int]chan struct{})}
+}
+
+// Start run in the background for a ticket. Stopping the ticket closes the
+// channel passed to run. Nothing is started once the session or the server
+// runs as many as allowed.
+func (m *WatchManager) Start(session string, ticket int, run func(stop <-chan struct{})) error {
+	stop := make(chan struct{})
+	m.mu.Lock()
+	if len(m.sessions[session]) >= maxSessionWatches {
+		m.mu.Unlock()
+		return fmt.Errorf("Session %s already runs %d watches and waits, stop one with /watch/stop first", session, maxSessionWatches)
+	}
+	total := 0
+	for _, tickets := range m.sessions {
+		total += len(tickets)
+	}
+	if total >= maxWatches {
+		m.mu.Unlock()
+		return fmt.Errorf("The server already runs %d watches and waits, try again later", maxWatches)
+	}
+	if m.sessions[session] == nil {
+		m.sessions[session] = make(map[int]chan struct{})
+	}
+	m.sessions[session][ticket] = stop
+	m.mu.Unlock()
+
+	mark := activity.Begin(session)
+	go func() {
+		run(stop)
+		activity.End(mark)
+		m.mu.Lock()
+		delete(m.sessions[session], ticket)
+		if len(m.sessions[session]) == 0 {
+			delete(m.sessions, session)
+		}
+		m.mu.Unlock()
+		// Tickets waiting on this one can run now
+		executor.Poke()
+	}()
+	return nil
+}
+
+// Active reports whether a ticket is a watch that is still running
+func (m *WatchManager) Active(session string, ticket int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.sessions[session][ticket]
+	return ok
+}
+
+// Stop a watch, returning false when it is not running
+func (m *WatchManager) Stop(session string, ticket int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stop, ok := m.sessions[session][ticket]
+	if !ok {
+		return false
+	}
+	select {
+	case <-stop:
+	default:
+		close(stop)
+	}
+	return true
+}
+
+// Stop the watches of a cleared session
+func (m *WatchManager) Drop(session string) {
+	m.mu.Lock()
+	var tickets []int
+	for ticket := range m.sessions[session] {
+		tickets = append(tickets, ticket)
+	}
+	m.mu.Unlock()
+	for _, ticket := range tickets {
+		m.Stop(session, ticket)
+	}
+}
+
+func (watch *Watch) run(stop <-chan struct{}) {
+	runner := watch.Runner
+	session := watch.Session
+	full, err := store.CreateOutput(session, runner.Ticket)
+	if err != nil {
+		logger.Printf("Failed to open output file for watch %d of session %s: %v", runner.Ticket, session, err)
+	} else {
+		defer full.Close()
+	}
+
+	runAs := ""
+	if runner.Identity != nil {
+		runAs = runner.Identity.User
+	}
+	cer := &CmdResults{
+		Type:     "watch",
+		Ticket:   runner.Ticket,
+		Session:  session,
+		Input:    runner.InputCmd,
+		B64Input: runner.CmdSubmission.B64Input,
+		RunAs:    runAs,
+		Elevated: runner.Elevated,
+		Sandbox:  sessionSandbox(runner.Config),
+	}
+	write := func() {
+		writeTicket(session, runner.Ticket, makePlainCer(cer))
+	}
+
+	startTicketMeta(runner, cer.Type, session)
+	start := time.Now()
+	deadline := start.Add(watch.Max)
+	var previous *limitedBuffer
+	previousCode := 0
+	for run := 1; ; run++ {
+		ctx, cancel := context.WithTimeout(context.Background(), ticketTimeout)
+		output := &limitedBuffer{max: maxDiffBytes}
+		cmd, err := buildCommand(ctx, session, runner, runner.InputCmd)
+		if err != nil {
+			cancel()
+			cer.StopReason = fmt.Sprintf("failed to prepare command: %v", err)
+			cer.ExitCode = -1
+			break
+		}
+		cmd.Stdout = output
+		cmd.Stderr = output
+		// Stopping the watch also ends a run that is still going
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err = cmd.Run()
+		cancel()
+		now := time.Now()
+
+		cer.Runs = run
+		cer.ExitCode = exitCode(err)
+		capture := newCappedOutput(nil, runner.HeadBytes, runner.TailBytes, 0)
+		capture.Write(output.Bytes())
+		cer.Output = capture.String()
+		cer.OutputBytes = output.total
+
+		if previous == nil || !previous.Equal(output) || cer.ExitCode != previousCode {
+			change := WatchChange{Run: run, At: now, ExitCode: cer.ExitCode}
+			if previous == nil {
+				change.Output = cer.Output
+			} else if previous.Equal(output) {
+				change.Diff = fmt.Sprintf("Output unchanged, the exit code changed from %d", previousCode)
+			} else if previous.Truncated() || output.Truncated() {
+				change.Diff = fmt.Sprintf("Output changed, it is too large to diff (over %d bytes)", maxDiffBytes)
+			} else {
+				diff := newCappedOutput(nil, runner.HeadBytes, runner.TailBytes, 0)
+				diff.Write([]byte(unifiedDiff("previous", "current", string(previous.Bytes()), string(output.Bytes()))))
+				change.Diff = diff.String()
+			}
+			cer.ChangeCount++
+			cer.Changes = append(cer.Changes, change)
+			if len(cer.Changes) > maxWatchChanges {
+				cer.Changes = cer.Changes[1:]
+			}
+			if full != nil {
+				fmt.Fprintf(full, "=== CHANGED AT %s (run %d, exit code %d) ===\n", now.Format(time.RFC3339), run, cer.ExitCode)
+				full.Write(output.Bytes())
+			}
+			previous, previousCode = output, cer.ExitCode
+		}
+
+		select {
+		case <-stop:
+			cer.StopReason = fmt.Sprintf("stopped at run %d", run)
+		default:
+		}
+		switch {
+		case cer.StopReason != "":
+		case watch.Until == watchUntilExit0 && cer.ExitCode == 0:
+			cer.StopReason = fmt.Sprintf("exit code 0 at run %d", run)
+		case watch.Until == watchUntilMatch && watch.Match.Match(output.Bytes()):
+			cer.StopReason = fmt.Sprintf("output matched %q at run %d", watch.Match.String(), run)
+		case now.Add(watch.Interval).After(deadline):
+			cer.StopReason = fmt.Sprintf("max duration %s reached", watch.Max)
+			// An unmet condition fails the ticket, like timeout(1) does
+			if watch.Until != "" {
+				cer.StopReason += fmt.Sprintf(" before %s", watch.Until)
+				cer.ExitCode = watchTimedOutCode
+			}
+		}
+		cer.Duration = time.Since(start).String()
+		if cer.StopReason != "" {
+			break
+		}
+
+		cer.Status = statusWatching
+		cer.Next = fmt.Sprintf("The command is still being watched every %s. Refresh this callback later to see new changes, or stop it at %s/watch/stop?hash=%s&session=%s&ticket=%d", watch.Interval, fqdn, hashPassword, session, runner.Ticket)
+		write()
+		cer.Status = ""
+
+		select {
+		case <-stop:
+			cer.StopReason = fmt.Sprintf("stopped after run %d", run)
+		case <-time.After(watch.Interval):
+		}
+		if cer.StopReason != "" {
+			break
+		}
+	}
+
+	cer.Duration = time.Since(start).String()
+	cer.Next = "This is your result. Review the changes. You can now issue your next command to /shell"
+	status := finishedStatus(cer)
+	switch {
+	case strings.HasPrefix(cer.StopReason, "stopped"):
+		status = ticketCancelled
+	case cer.ExitCode == watchTimedOutCode:
+		status = ticketTimedOut
+	}
+	cer.Status = strings.ToUpper(status)
+	write()
+	finishTicketMeta(cer, status)
+	logger.Printf("WATCH DONE: %s : %d : %s", session, runner.Ticket, cer.StopReason)
+}
+
+// limitedBuffer keeps the first max bytes written to it and counts the rest
+type limitedBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	max   int
+	total int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.total += int64(len(p))
+	if room := b.max - len(b.buf); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.buf = append(b.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf
+}
+
+func (b *limitedBuffer) Truncated() bool {
+	return b.total > int64(len(b.buf))
+}
+
+func (b *limitedBuffer) Equal(other *limitedBuffer) bool {
+	return b.total == other.total && bytes.Equal(b.buf, other.buf)
+}
+
+// Start a watch, or stop one with /watch/stop
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+
+	if r.URL.Path == "/watch/stop" {
+		ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+		if err != nil {
+			writePlainMessage(w, errTicketMessage)
+			return
+		}
+		if !watches.Stop(session, ticket) {
+			writePlainMessage(w, fmt.Sprintf("Ticket %d is not an active watch or wait", ticket))
+			return
+		}
+		logger.Printf("WATCH STOP: %s : %d", session, ticket)
+		writePlainMessage(w, fmt.Sprintf("Stopping ticket %d, its final result will be at %s", ticket, Callback(session, ticket)))
+		return
+	}
+
+	b64CmdParam := r.URL.Query().Get("b64cmd")
+	cmdParam := r.URL.Query().Get("cmd")
+	inputCmd := cmdParam
+	if b64CmdParam != "" {
+		decodedBytes, err := base64.StdEncoding.DecodeString(b64CmdParam)
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to decode base64 command: %v", err))
+			return
+		}
+		inputCmd = string(decodedBytes)
+	} else {
+		b64CmdParam = base64.StdEncoding.EncodeToString([]byte(cmdParam))
+	}
+	if inputCmd == "" {
+		writePlainMessage(w, "Invalid or missing 'cmd' or 'b64cmd' parameter")
+		return
+	}
+
+	watch := &Watch{
+		Session:  session,
+		Interval: defaultWatchInterval,
+		Max:      defaultWatchMax,
+		Until:    r.URL.Query().Get("until"),
+	}
+	if interval := r.URL.Query().Get("interval"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d < minWatchInterval {
+			writePlainMessage(w, fmt.Sprintf("Invalid 'interval' parameter, use a duration of at least %s like 30s", minWatchInterval))
+			return
+		}
+		watch.Interval = d
+	}
+	if max := r.URL.Query().Get("max"); max != "" {
+		d, err := time.ParseDuration(max)
+		if err != nil || d <= 0 || d > maxWatchMax {
+			writePlainMessage(w, fmt.Sprintf("Invalid 'max' parameter, use a duration up to %s like 30m", maxWatchMax))
+			return
+		}
+		watch.Max = d
+	}
+	if b64Match := r.URL.Query().Get("b64match"); b64Match != "" {
+		pattern, err := base64.StdEncoding.DecodeString(b64Match)
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to decode 'b64match': %v", err))
+			return
+		}
+		if watch.Match, err = regexp.Compile(string(pattern)); err != nil {
+			writePlainMessage(w, fmt.Sprintf("Invalid 'b64match' regular expression: %v", err))
+			return
+		}
+		if watch.Until == "" {
+			watch.Until = watchUntilMatch
+		}
+	}
+	switch watch.Until {
+	case "", watchUntilExit0:
+	case watchUntilMatch:
+		if watch.Match == nil {
+			writePlainMessage(w, "'until=match' needs a 'b64match' regular expression")
+			return
+		}
+	default:
+		writePlainMessage(w, "Invalid 'until' parameter, use 'exit0' or 'match'")
+		return
+	}
+
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+	headBytes, tailBytes, err := queryOutputCaps(r)
+	if err != nil {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+
+	forest, err := newTicket(r, session, inputCmd, b64CmdParam, elevated)
+	if err != nil {
+		logger.Print(err)
+		writePlainMessage(w, err.Error())
+		return
+	}
+	forest.HeadBytes = headBytes
+	forest.TailBytes = tailBytes
+	forest.CmdSubmission.Type = "watch"
+	forest.CmdSubmission.Status = statusWatching
+	watch.Runner = forest
+	if err := watches.Start(session, forest.Ticket, watch.run); err != nil {
+		cancelTicket(forest, "watch", session, err.Error())
+		writePlainMessage(w, err.Error())
+		return
+	}
+
+	logger.Printf("WATCH: %s : %s : every %s : %s\n", session, inputCmd, watch.Interval, Callback(session, forest.Ticket))
+	writePlainCsr(w, forest.CmdSubmission)
+}
+
+const (
+	defaultWaitTimeout  = 5 * time.Minute
+	maxWaitTimeout      = time.Hour
+	defaultWaitInterval = time.Second
+	minWaitInterval     = 250 * time.Millisecond
+	waitProbeTimeout    = 2 * time.Second
+)
+
+// waitProbe checks one condition. Check reports whether it holds and
+// describes what it saw.
+type waitProbe struct {
+	Kind   string // tcp, http, file, process or cmd
+	Target string
+	Status int // Expected HTTP status, 0 accepts any 2xx
+	Runner *Runnner
+}
+
+func (p *waitProbe) String() string {
+	switch p.Kind {
+	case "tcp":
+		return fmt.Sprintf("port %s to accept connections", p.Target)
+	case "http":
+		if p.Status != 0 {
+			return fmt.Sprintf("%s to answer with status %d", p.Target, p.Status)
+		}
+		return fmt.Sprintf("%s to answer with a 2xx status", p.Target)
+	case "file":
+		return fmt.Sprintf("%s to exist", p.Target)
+	case "process":
+		return fmt.Sprintf("a process named %s", p.Target)
+	}
+	return "the command to exit with code 0"
+}
+
+func (p *waitProbe) Check(ctx context.Context, session string) (bool, string) {
+	switch p.Kind {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", p.Target, waitProbeTimeout)
+		if err != nil {
+			return false, err.Error()
+		}
+		conn.Close()
+		return true, fmt.Sprintf("%s accepted a connection", p.Target)
+	case "http":
+		client := &http.Client{
+			Timeout: waitProbeTimeout,
+			// Report redirects instead of following them off localhost
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := client.Get(p.Target)
+		if err != nil {
+			return false, err.Error()
+		}
+		resp.Body.Close()
+		ok := resp.StatusCode == p.Status || (p.Status == 0 && resp.StatusCode/100 == 2)
+		return ok, fmt.Sprintf("%s answered %s", p.Target, resp.Status)
+	case "process":
+		pids := processesNamed(p.Target)
+		if len(pids) == 0 {
+			return false, fmt.Sprintf("no process named %s", p.Target)
+		}
+		return true, fmt.Sprintf("process %s is running as pid %s", p.Target, joinTickets(pids))
+	}
+
+	// Files are checked as the session user so sandboxes and permissions apply
+	input := p.Target
+	if p.Kind == "file" {
+		input = "test -e " + shellQuote(p.Target)
+	}
+	cmd, err := buildCommand(ctx, session, p.Runner, input)
+	if err != nil {
+		return false, fmt.Sprintf("failed to prepare command: %v", err)
+	}
+	capture := newCappedOutput(nil, p.Runner.HeadBytes, p.Runner.TailBytes, 0)
+	cmd.Stdout = capture
+	cmd.Stderr = capture
+	code := exitCode(cmd.Run())
+	if p.Kind == "file" {
+		if code != 0 {
+			return false, fmt.Sprintf("%s does not exist", p.Target)
+		}
+		return true, fmt.Sprintf("%s exists", p.Target)
+	}
+	return code == 0, fmt.Sprintf("exit code %d\n\n%s", code, capture.String())
+}
+
+// Find the pids of processes whose name is name, like pgrep -x
+func processesNamed(name string) []int {
+	// The kernel truncates process names to 15 bytes
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	dirs, _ := filepath.Glob("/proc/[0-9]*/comm")
+	var pids []int
+	for _, file := range dirs {
+		comm, err := os.ReadFile(file)
+		if err != nil || strings.TrimSuffix(string(comm), "\n") != name {
+			continue
+		}
+		if pid, err := strconv.Atoi(filepath.Base(filepath.Dir(file))); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// Quote s as a single word for bash
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Probe a condition until it holds or the timeout expires, keeping the
+// ticket up to date while waiting
+func runWait(runner *Runnner, session string, probe *waitProbe, interval, timeout time.Duration) func(stop <-chan struct{}) {
+	return func(stop <-chan struct{}) {
+		runAs := ""
+		if runner.Identity != nil {
+			runAs = runner.Identity.User
+		}
+		cer := &CmdResults{
+			Type:     "wait",
+			Ticket:   runner.Ticket,
+			Session:  session,
+			Input:    runner.InputCmd,
+			B64Input: runner.CmdSubmission.B64Input,
+			RunAs:    runAs,
+			Elevated: runner.Elevated,
+			Sandbox:  sessionSandbox(runner.Config),
+		}
+		write := func() {
+			writeTicket(session, runner.Ticket, makePlainCer(cer))
+		}
+
+		startTicketMeta(runner, cer.Type, session)
+		start := time.Now()
+		deadline := start.Add(timeout)
+		for attempt := 1; ; attempt++ {
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			ok, detail := probe.Check(ctx, session)
+			cancel()
+			cer.Duration = time.Since(start).String()
+			if ok {
+				cer.ExitCode = 0
+				cer.Output = fmt.Sprintf("Condition met on check %d: %s", attempt, detail)
+				break
+			}
+
+			stopped := false
+			if time.Now().Add(interval).Before(deadline) {
+				cer.Status = statusWaiting
+				cer.Next = fmt.Sprintf("Still waiting for %s. Refresh this callback later, or stop it at %s/watch/stop?hash=%s&session=%s&ticket=%d", probe, fqdn, hashPassword, session, runner.Ticket)
+				cer.Output = fmt.Sprintf("Check %d: %s", attempt, detail)
+				write()
+				cer.Status = ""
+				select {
+				case <-stop:
+					stopped = true
+				case <-time.After(interval):
+					continue
+				}
+			}
+			// An unmet condition fails the ticket, like timeout(1) does
+			cer.ExitCode = watchTimedOutCode
+			cer.Output = fmt.Sprintf("Timed out after %s and %d checks, the last check saw: %s", timeout, attempt, detail)
+			if stopped {
+				cer.ExitCode = -1
+				cer.Output = fmt.Sprintf("Stopped after %d checks, the last check saw: %s", attempt, detail)
+			}
+			break
+		}
+
+		cer.Duration = time.Since(start).String()
+		cer.Next = "This is your result. You can now issue your next command to /shell"
+		status := finishedStatus(cer)
+		switch cer.ExitCode {
+		case watchTimedOutCode:
+			status = ticketTimedOut
+		case -1:
+			status = ticketCancelled
+		}
+		cer.Status = strings.ToUpper(status)
+		write()
+		finishTicketMeta(cer, status)
+		logger.Printf("WAIT DONE: %s : %d : exit %d", session, runner.Ticket, cer.ExitCode)
+	}
+}
+
+// Wait for a condition in a ticket of its own, outside the worker pool
+func waitHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+
+	probe := &waitProbe{}
+	for _, kind := range []string{"tcp", "http", "file", "process", "b64cmd"} {
+		value := r.URL.Query().Get(kind)
+		if value == "" {
+			continue
+		}
+		if probe.Kind != "" {
+			probe.Kind = ""
+			break
+		}
+		probe.Kind, probe.Target = kind, value
+	}
+	switch probe.Kind {
+	case "":
+		writePlainMessage(w, "Provide exactly one of 'tcp', 'http', 'file', 'process' or 'b64cmd'")
+		return
+	case "tcp":
+		// A bare port means localhost
+		if _, err := strconv.Atoi(probe.Target); err == nil {
+			probe.Target = net.JoinHostPort("localhost", probe.Target)
+		}
+		host, _, err := net.SplitHostPort(probe.Target)
+		if err != nil {
+			writePlainMessage(w, "Invalid 'tcp' parameter, use a port like 8080 or host:port")
+			return
+		}
+		if host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			writePlainMessage(w, "Invalid 'tcp' parameter, only localhost can be probed")
+			return
+		}
+	case "http":
+		target, err := url.Parse(probe.Target)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+			writePlainMessage(w, "Invalid 'http' parameter, use a URL like http://localhost:8080/health")
+			return
+		}
+		if host := target.Hostname(); host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			writePlainMessage(w, "Invalid 'http' parameter, only localhost can be probed")
+			return
+		}
+		if status := r.URL.Query().Get("status"); status != "" {
+			if probe.Status, err = strconv.Atoi(status); err != nil || probe.Status < 100 || probe.Status > 599 {
+				writePlainMessage(w, "Invalid 'status' parameter, use an HTTP status like 200")
+				return
+			}
+		}
+	case "b64cmd":
+		decodedBytes, err := base64.StdEncoding.DecodeString(probe.Target)
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to decode base64 command: %v", err))
+			return
+		}
+		probe.Kind, probe.Target = "cmd", string(decodedBytes)
+	}
+
+	// tcp and http probes dial from the server, which cannot see the
+	// loopback of a session with a network of its own
+	if probe.Kind == "tcp" || probe.Kind == "http" {
+		cfg, err := loadSessionConfig(filepath.Join(sessionsDir, session))
+		if err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		if sessionSandbox(cfg) == sandboxNamespace && sessionNetwork(cfg) == "none" {
+			writePlainMessage(w, fmt.Sprintf("Session %s has a network of its own that the '%s' probe cannot reach, probe it with 'b64cmd' instead", session, probe.Kind))
+			return
+		}
+	}
+
+	timeout := defaultWaitTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 || d > maxWaitTimeout {
+			writePlainMessage(w, fmt.Sprintf("Invalid 'timeout' parameter, use a duration up to %s like 2m", maxWaitTimeout))
+			return
+		}
+		timeout = d
+	}
+	interval := defaultWaitInterval
+	if value := r.URL.Query().Get("interval"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < minWaitInterval {
+			writePlainMessage(w, fmt.Sprintf("Invalid 'interval' parameter, use a duration of at least %s like 2s", minWaitInterval))
+			return
+		}
+		interval = d
+	}
+
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+
+	input := fmt.Sprintf("wait for %s", probe)
+	b64Input := ""
+	if probe.Kind == "cmd" {
+		input, b64Input = probe.Target, r.URL.Query().Get("b64cmd")
+	}
+	forest, err := newTicket(r, session, input, b64Input, elevated)
+	if err != nil {
+		logger.Print(err)
+		writePlainMessage(w, err.Error())
+		return
+	}
+	probe.Runner = forest
+	forest.CmdSubmission.Type = "wait"
+	forest.CmdSubmission.Status = statusWaiting
+	if err := watches.Start(session, forest.Ticket, runWait(forest, session, probe, interval, timeout)); err != nil {
+		cancelTicket(forest, "wait", session, err.Error())
+		writePlainMessage(w, err.Error())
+		return
+	}
+
+	logger.Printf("WAIT: %s : %s : %s\n", session, input, Callback(session, forest.Ticket))
+	writePlainCsr(w, forest.CmdSubmission)
+}
+
+const (
+	uploadsFolder  = "uploads"
+	maxUploadParts = 10000
+	uploadMaxAge   = 24 * time.Hour
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// Uploads assemble a payload too large for one URL from numbered parts. They
+// live in the session folder until they are committed or go stale.
+func uploadDir(session string, id string) (string, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return "", fmt.Errorf("Invalid or missing 'id' parameter")
+	}
+	dir := filepath.Join(sessionsDir, session, uploadsFolder, id)
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("Upload %s does not exist", id)
+	}
+	return dir, nil
+}
+
+func uploadPartPath(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%05d.part", n))
+}
+
+// Remove uploads nobody touched for a day
+func sweepUploads(session string) {
+	dirs, _ := filepath.Glob(filepath.Join(sessionsDir, session, uploadsFolder, "*"))
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err == nil && time.Since(info.ModTime()) > uploadMaxAge {
+			logger.Printf("Removing stale upload %s", dir)
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// Bytes stored so far and the number of contiguous parts from part 1
+func uploadSize(dir string) (int64, int) {
+	var size int64
+	parts, _ := filepath.Glob(filepath.Join(dir, "*.part"))
+	for _, part := range parts {
+		if info, err := os.Stat(part); err == nil {
+			size += info.Size()
+		}
+	}
+	count := 0
+	for count < maxUploadParts {
+		if _, err := os.Stat(uploadPartPath(dir, count+1)); err != nil {
+			break
+		}
+		count++
+	}
+	return size, count
+}
+
+func uploadLink(action string, session string, id string) string {
+	return fmt.Sprintf("%s/upload/%s?hash=%s&session=%s&id=%s", fqdn, action, hashPassword, session, id)
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, "/upload/")
+	switch action {
+	case "begin":
+		sweepUploads(session)
+		raw := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to create upload id: %v", err))
+			return
+		}
+		id := hex.EncodeToString(raw)
+		if err := os.MkdirAll(filepath.Join(sessionsDir, session, uploadsFolder, id), 0700); err != nil {
+			msg := fmt.Sprintf("Failed to create upload: %v", err)
+			logger.Print(msg)
+			writePlainMessage(w, msg)
+			return
+		}
+		logger.Printf("UPLOAD BEGIN: %s : %s", session, id)
+
+		res := fmt.Sprintf("HELLO LLM, YOUR UPLOAD HAS BEGUN!\n\n")
+		res += fmt.Sprintf("Send the payload in order as base64 parts numbered from 1 with PART, then call COMMIT with the sha256 of the whole payload.\n\n")
+		res += fmt.Sprintf("UPLOAD_ID: %s\n", id)
+		res += fmt.Sprintf("MAX_BYTES: %d\n", uploadMaxBytes)
+		res += fmt.Sprintf("PART: %s&n=1&b64=\n", uploadLink("part", session, id))
+		res += fmt.Sprintf("COMMIT: %s&sha256=&as=cmd\n", uploadLink("commit", session, id))
+		fmt.Fprint(w, res)
+	case "part":
+		dir, err := uploadDir(session, r.URL.Query().Get("id"))
+		if err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n < 1 || n > maxUploadParts {
+			writePlainMessage(w, fmt.Sprintf("Invalid or missing 'n' parameter, parts are numbered 1 to %d", maxUploadParts))
+			return
+		}
+		data, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("b64"))
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to decode 'b64': %v", err))
+			return
+		}
+		// Resending a part replaces it
+		size, _ := uploadSize(dir)
+		if info, err := os.Stat(uploadPartPath(dir, n)); err == nil {
+			size -= info.Size()
+		}
+		if size+int64(len(data)) > uploadMaxBytes {
+			writePlainMessage(w, fmt.Sprintf("Upload would be larger than %d bytes", uploadMaxBytes))
+			return
+		}
+		if err := os.WriteFile(uploadPartPath(dir, n), data, 0600); err != nil {
+			msg := fmt.Sprintf("Failed to store part %d: %v", n, err)
+			logger.Print(msg)
+			writePlainMessage(w, msg)
+			return
+		}
+		now := time.Now()
+		os.Chtimes(dir, now, now)
+		size, count := uploadSize(dir)
+		msg := fmt.Sprintf("Stored part %d with %d bytes, the upload holds %d bytes", n, len(data), size)
+		if parts, _ := filepath.Glob(filepath.Join(dir, "*.part")); len(parts) != count {
+			msg += fmt.Sprintf(" and part %d is still missing", count+1)
+		} else {
+			msg += fmt.Sprintf(" in parts 1 to %d", count)
+		}
+		writePlainMessage(w, msg)
+	case "commit":
+		commitUpload(w, r, session)
+	default:
+		writePlainMessage(w, fmt.Sprintf("Unknown upload action: %s", action))
+	}
+}
+
+// Assemble and verify an upload, then run it as a command, feed it to a
+// command as stdin or write it to a file in the session workspace
+func commitUpload(w http.ResponseWriter, r *http.Request, session string) {
+	id := r.URL.Query().Get("id")
+	dir, err := uploadDir(session, id)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	want := strings.ToLower(r.URL.Query().Get("sha256"))
+	if want == "" {
+		writePlainMessage(w, "Invalid or missing 'sha256' parameter")
+		return
+	}
+	as := r.URL.Query().Get("as")
+	if as == "" {
+		as = "cmd"
+	}
+	if as != "cmd" && as != "stdin" && as != "file" {
+		writePlainMessage(w, "The 'as' parameter must be 'cmd', 'stdin' or 'file'")
+		return
+	}
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+
+	size, count := uploadSize(dir)
+	if count == 0 {
+		writePlainMessage(w, fmt.Sprintf("Upload %s has no parts, part 1 is missing", id))
+		return
+	}
+	if parts, _ := filepath.Glob(filepath.Join(dir, "*.part")); len(parts) != count {
+		writePlainMessage(w, fmt.Sprintf("Upload %s is missing part %d", id, count+1))
+		return
+	}
+	if size > uploadMaxBytes {
+		writePlainMessage(w, fmt.Sprintf("Upload is larger than %d bytes", uploadMaxBytes))
+		return
+	}
+	payload := make([]byte, 0, size)
+	for n := 1; n <= count; n++ {
+		part, err := os.ReadFile(uploadPartPath(dir, n))
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to read part %d: %v", n, err))
+			return
+		}
+		payload = append(payload, part...)
+	}
+	sum := sha256.Sum256(payload)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		writePlainMessage(w, fmt.Sprintf("Checksum mismatch, the %d bytes in parts 1 to %d have sha256 %s. Resend the wrong parts and commit again.", len(payload), count, got))
+		return
+	}
+
+	switch as {
+	case "file":
+		path, identity, err := workspaceTarget(session, r.URL.Query().Get("path"), elevated)
+		if err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		mode, err := queryMode(r, path)
+		if err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		if err := checkQuota(session, path, int64(len(payload))); err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		if err := writeWorkspaceFile(session, path, payload, mode, identity); err != nil {
+			msg := fmt.Sprintf("Failed to write %s: %v", path, err)
+			logger.Print(msg)
+			writePlainMessage(w, msg)
+			return
+		}
+		os.RemoveAll(dir)
+		logger.Printf("UPLOAD FILE: %s : %s : %s", session, id, path)
+		writePlainMessage(w, fmt.Sprintf("Wrote %d bytes to %s", len(payload), path))
+		return
+	case "stdin":
+		inputCmd := r.URL.Query().Get("cmd")
+		b64Input := r.URL.Query().Get("b64cmd")
+		if b64Input != "" {
+			decodedBytes, err := base64.StdEncoding.DecodeString(b64Input)
+			if err != nil {
+				writePlainMessage(w, fmt.Sprintf("Failed to decode base64 command: %v", err))
+				return
+			}
+			inputCmd = string(decodedBytes)
+		}
+		if inputCmd == "" {
+			writePlainMessage(w, "Invalid or missing 'cmd' or 'b64cmd' parameter to read the upload from stdin")
+			return
+		}
+		forest, err := newTicket(r, session, inputCmd, b64Input, elevated)
+		if err != nil {
+			logger.Print(err)
+			writePlainMessage(w, err.Error())
+			return
+		}
+		forest.Stdin = payload
+		os.RemoveAll(dir)
+		logger.Printf("UPLOAD STDIN: %s : %s : %s : %s\n", session, id, inputCmd, Callback(session, forest.Ticket))
+		dispatchTicket(w, r, forest, session)
+	case "cmd":
+		forest, err := newTicket(r, session, string(payload), base64.StdEncoding.EncodeToString(payload), elevated)
+		if err != nil {
+			logger.Print(err)
+			writePlainMessage(w, err.Error())
+			return
+		}
+		os.RemoveAll(dir)
+		logger.Printf("UPLOAD CMD: %s : %s : %s\n", session, id, Callback(session, forest.Ticket))
+		dispatchTicket(w, r, forest, session)
+	}
+}
+
+const (
+	fileReadBytes    = 64 * 1024   // Default bytes returned by /file/read
+	maxFileReadBytes = 1024 * 1024 // Most bytes returned by one /file/read
+	binarySniffBytes = 8000        // Bytes inspected to tell text from binary
+)
+
+// A file is treated as binary when its first bytes hold a NUL or are not UTF-8
+func isBinary(sample []byte) bool {
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+	// The sample may end in the middle of a rune
+	for i := 0; i < utf8.UTFMax && len(sample) > 0; i++ {
+		if utf8.Valid(sample) {
+			return false
+		}
+		sample = sample[:len(sample)-1]
+	}
+	return !utf8.Valid(sample)
+}
+
+// Parse a line range like "10-40", "10-" or "10"; last is 0 when open ended
+func parseLineRange(value string) (int, int, error) {
+	from, to, ranged := strings.Cut(value, "-")
+	first, err := strconv.Atoi(from)
+	if err != nil || first < 1 {
+		return 0, 0, fmt.Errorf("invalid lines: %s", value)
+	}
+	if !ranged {
+		return first, first, nil
+	}
+	if to == "" {
+		return first, 0, nil
+	}
+	last, err := strconv.Atoi(to)
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid lines: %s", value)
+	}
+	return first, last, nil
+}
+
+// Prefix every line with its number, starting at first
+func numberLines(data []byte, first int) string {
+	var b strings.Builder
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		fmt.Fprintf(&b, "%6d\t%s", first+i, line)
+	}
+	if !strings.HasSuffix(b.String(), "\n") {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func fileLink(action string, session string, path string) string {
+	return fmt.Sprintf("%s/file/%s?hash=%s&session=%s&path=%s", fqdn, action, hashPassword, session, url.QueryEscape(path))
+}
+
+func fileHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodHead {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, "/file/")
+	switch action {
+	case "read":
+		readFile(w, r, session)
+	case "write":
+		writeFile(w, r, session)
+	case "edit":
+		editFile(w, r, session)
+	case "revert":
+		revertEdit(w, r, session)
+	case "download":
+		path, err := workspaceFile(session, r.URL.Query().Get("path"))
+		if err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		file, info, err := openWorkspaceFile(session, path)
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to open %s: %v", path, err))
+			return
+		}
+		defer file.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+		http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
+	default:
+		writePlainMessage(w, fmt.Sprintf("Unknown file action: %s", action))
+	}
+}
+
+// Return part of a workspace file, numbered text or base64 for binary files.
+// 'offset' and 'limit' select bytes, 'lines' selects a range of lines.
+func readFile(w http.ResponseWriter, r *http.Request, session string) {
+	path, err := workspaceFile(session, r.URL.Query().Get("path"))
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+	limit, err := queryInt(r, "limit", fileReadBytes)
+	if err != nil || limit == 0 {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+	if limit > maxFileReadBytes {
+		limit = maxFileReadBytes
+	}
+
+	file, info, err := openWorkspaceFile(session, path)
+	if err != nil {
+		writePlainMessage(w, fmt.Sprintf("Failed to open %s: %v", path, err))
+		return
+	}
+	defer file.Close()
+	sample := make([]byte, binarySniffBytes)
+	n, _ := file.ReadAt(sample, 0)
+	binary := isBinary(sample[:n])
+
+	res := fmt.Sprintf("HELLO LLM, HERE IS THE REQUESTED FILE RANGE!\n\n")
+	res += fmt.Sprintf("SESSION: %s\n\n", session)
+	res += fmt.Sprintf("PATH: %s\n\n", path)
+	res += fmt.Sprintf("TOTAL_BYTES: %d\n\n", info.Size())
+
+	if linesParam := r.URL.Query().Get("lines"); linesParam != "" {
+		if binary {
+			writePlainMessage(w, fmt.Sprintf("%s is binary, read it with 'offset' and 'limit' instead of 'lines'", path))
+			return
+		}
+		first, last, err := parseLineRange(linesParam)
+		if err != nil {
+			writePlainMessage(w, errRangeMessage)
+			return
+		}
+		// Lines are read in bounded chunks, so a file without line breaks is
+		// never held in memory whole, and a line longer than limit is cut
+		reader := bufio.NewReaderSize(file, 64*1024)
+		var data []byte
+		var start, pos int64
+		line, next, lineAt := 1, 0, 0
+		fresh, cut := true, false
+		for {
+			chunk, err := reader.ReadSlice('\n')
+			if len(chunk) > 0 {
+				if fresh {
+					if line == first {
+						start = pos
+					}
+					lineAt = len(data)
+				}
+				if line >= first && len(data)+len(chunk) > limit {
+					if lineAt > 0 {
+						// The line no longer fits after the ones before it
+						data = data[:lineAt]
+						next = line
+					} else {
+						data = append(data, chunk[:limit-len(data)]...)
+						cut = true
+						next = line + 1
+					}
+					break
+				}
+				if line >= first {
+					data = append(data, chunk...)
+				}
+				pos += int64(len(chunk))
+				fresh = chunk[len(chunk)-1] == '\n'
+				if fresh {
+					line++
+				}
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil {
+				// The last line has no line break
+				if !fresh {
+					line++
+				}
+				break
+			}
+			if last > 0 && line > last {
+				break
+			}
+		}
+		if line <= first && next == 0 {
+			writePlainMessage(w, fmt.Sprintf("%s has only %d lines", path, line-1))
+			return
+		}
+		shown := line - 1
+		if next > 0 {
+			shown = next - 1
+		}
+		if last > 0 && next > last {
+			next = 0
+		}
+		res += fmt.Sprintf("ENCODING: text\n\n")
+		res += fmt.Sprintf("LINES: %d-%d\n\n", first, shown)
+		res += fmt.Sprintf("RANGE: %d-%d\n\n", start, start+int64(len(data)))
+		if cut {
+			res += fmt.Sprintf("WARNING: line %d is longer than %d bytes and was cut, read the rest of it with offset=%d\n\n", shown, limit, start+int64(len(data)))
+		}
+		if next > 0 {
+			rest := ""
+			if last > 0 {
+				rest = strconv.Itoa(last)
+			}
+			res += fmt.Sprintf("NEXT:\n\n%s&lines=%d-%s&limit=%d\n\n", fileLink("read", session, path), next, rest, limit)
+		}
+		res += fmt.Sprintf("CONTENT:\n\n%s\n", numberLines(data, first))
+		fmt.Fprint(w, res)
+		return
+	}
+
+	buf := make([]byte, limit)
+	n, err = file.ReadAt(buf, int64(offset))
+	if err != nil && err != io.EOF {
+		writePlainMessage(w, fmt.Sprintf("Failed to read %s: %v", path, err))
+		return
+	}
+	data := buf[:n]
+	if binary {
+		res += fmt.Sprintf("ENCODING: base64\n\n")
+	} else {
+		// Stop at the last complete line unless the range holds only part of one
+		if int64(offset+n) < info.Size() {
+			if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+				data = data[:i+1]
+			}
+		}
+		res += fmt.Sprintf("ENCODING: text\n\n")
+	}
+	res += fmt.Sprintf("RANGE: %d-%d\n\n", offset, offset+len(data))
+	if next := int64(offset + len(data)); next < info.Size() {
+		res += fmt.Sprintf("NEXT:\n\n%s&offset=%d&limit=%d\n\n", fileLink("read", session, path), next, limit)
+	}
+	if binary {
+		res += fmt.Sprintf("CONTENT:\n\n%s\n\n", base64.StdEncoding.EncodeToString(data))
+		fmt.Fprint(w, res)
+		return
+	}
+
+	// Number the lines from the line the offset falls in
+	first := 1
+	if offset > 0 {
+		counted, err := countLines(file, int64(offset))
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to read %s: %v", path, err))
+			return
+		}
+		first += counted
+	}
+	res += fmt.Sprintf("CONTENT:\n\n%s\n", numberLines(data, first))
+	fmt.Fprint(w, res)
+}
+
+// Count the newlines in the first n bytes of file
+func countLines(file *os.File, n int64) (int, error) {
+	count := 0
+	buf := make([]byte, 32*1024)
+	reader := io.NewSectionReader(file, 0, n)
+	for {
+		read, err := reader.Read(buf)
+		count += bytes.Count(buf[:read], []byte{'\n'})
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+// Atomically replace a workspace file with the base64 'b64' parameter or
+// the body of a POST, as the session user
+func writeFile(w http.ResponseWriter, r *http.Request, session string) {
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+	data, err := requestData(r, "b64")
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	if data == nil && r.Method != http.MethodPost {
+		writePlainMessage(w, "Invalid or missing 'b64' parameter, or send the content as a POST body")
+		return
+	}
+	path, identity, err := workspaceTarget(session, r.URL.Query().Get("path"), elevated)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	mode, err := queryMode(r, path)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	if err := checkQuota(session, path, int64(len(data))); err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	if err := writeWorkspaceFile(session, path, data, mode, identity); err != nil {
+		msg := fmt.Sprintf("Failed to write %s: %v", path, err)
+		logger.Print(msg)
+		writePlainMessage(w, msg)
+		return
+	}
+	sum := sha256.Sum256(data)
+	logger.Printf("FILE WRITE: %s : %s : %d bytes", session, path, len(data))
+	writePlainMessage(w, fmt.Sprintf("Wrote %d bytes with mode %04o and sha256 %s to %s", len(data), mode, hex.EncodeToString(sum[:]), path))
+}
+
+// FileEdit is kept as NN.edit next to the ticket that logged an edit, with
+// the previous content in NN.backup, so the edit can be reverted
+type FileEdit struct {
+	Path    string      `json:"path"`
+	Existed bool        `json:"existed"` // The file existed before the edit
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Exists  bool        `json:"exists"`           // The file exists after the edit
+	SHA256  string      `json:"sha256,omitempty"` // Of the content after the edit
+}
+
+// Edits read and replace whole files, so they run one at a time
+var editMu sync.Mutex
+
+func ticketEditPath(sessionFolder string, ticket int) string {
+	return filepath.Join(sessionFolder, fmt.Sprintf("%02d.edit", ticket))
+}
+
+func ticketBackupPath(sessionFolder string, ticket int) string {
+	return filepath.Join(sessionFolder, fmt.Sprintf("%02d.backup", ticket))
+}
+
+// patchHunk is one hunk of a unified diff, without its line numbers for b
+type patchHunk struct {
+	oldStart int
+	old      []string
+	new      []string
+}
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// Parse the hunks of a unified diff of one file. File headers are ignored.
+func parsePatch(patch string) ([]patchHunk, error) {
+	var hunks []patchHunk
+	lines := strings.Split(strings.TrimSuffix(patch, "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		m := hunkHeaderPattern.FindStringSubmatch(lines[i])
+		if m == nil {
+			continue
+		}
+		oldStart, _ := strconv.Atoi(m[1])
+		oldCount, newCount := 1, 1
+		if m[2] != "" {
+			oldCount, _ = strconv.Atoi(m[2])
+		}
+		if m[4] != "" {
+			newCount, _ = strconv.Atoi(m[4])
+		}
+		hunk := patchHunk{oldStart: oldStart}
+		for len(hunk.old) < oldCount || len(hunk.new) < newCount {
+			i++
+			if i >= len(lines) {
+				return nil, fmt.Errorf("hunk %d ends early, its header promises %d old and %d new lines", len(hunks)+1, oldCount, newCount)
+			}
+			line := lines[i]
+			switch {
+			case strings.HasPrefix(line, "\\"):
+				// "\ No newline at end of file"
+			case line == "" || line[0] == ' ':
+				// Editors strip the space of empty context lines
+				if line != "" {
+					line = line[1:]
+				}
+				hunk.old = append(hunk.old, line)
+				hunk.new = append(hunk.new, line)
+			case line[0] == '-':
+				hunk.old = append(hunk.old, line[1:])
+			case line[0] == '+':
+				hunk.new = append(hunk.new, line[1:])
+			default:
+				return nil, fmt.Errorf("hunk %d has an invalid line: %q", len(hunks)+1, line)
+			}
+		}
+		if len(hunk.old) != oldCount || len(hunk.new) != newCount {
+			return nil, fmt.Errorf("hunk %d has %d old and %d new lines, its header promises %d and %d", len(hunks)+1, len(hunk.old), len(hunk.new), oldCount, newCount)
+		}
+		hunks = append(hunks, hunk)
+	}
+	if len(hunks) == 0 {
+		return nil, fmt.Errorf("the patch holds no @@ hunks")
+	}
+	return hunks, nil
+}
+
+// Apply hunks to text. A hunk whose lines moved is searched for from its
+// stated position outwards, so patches against a slightly older version of
+// the file still apply.
+func applyPatch(text string, hunks []patchHunk) (string, error) {
+	lines := splitLines(text)
+	result := make([]string, 0, len(lines))
+	pos, drift := 0, 0
+	for n, hunk := range hunks {
+		// A hunk without old lines inserts after line oldStart
+		want := hunk.oldStart - 1
+		if len(hunk.old) == 0 {
+			want = hunk.oldStart
+		}
+		want += drift
+		at := -1
+		for d := 0; at < 0 && (want-d >= pos || want+d <= len(lines)-len(hunk.old)); d++ {
+			for _, i := range []int{want - d, want + d} {
+				if i >= pos && i <= len(lines)-len(hunk.old) && equalLines(lines[i:i+len(hunk.old)], hunk.old) {
+					at = i
+					break
+				}
+			}
+		}
+		if at < 0 {
+			return "", fmt.Errorf("hunk %d (@@ -%d,%d) does not match the file, read it again and rebuild the patch", n+1, hunk.oldStart, len(hunk.old))
+		}
+		result = append(result, lines[pos:at]...)
+		result = append(result, hunk.new...)
+		pos = at + len(hunk.old)
+		drift = at - (want - drift)
+	}
+	result = append(result, lines[pos:]...)
+	return joinLines(result, text == "" || strings.HasSuffix(text, "\n")), nil
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func joinLines(lines []string, newline bool) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	text := strings.Join(lines, "\n")
+	if newline {
+		text += "\n"
+	}
+	return text
+}
+
+// Replace lines first to last (0 for the end of the file) with replacement
+func replaceLines(text string, first, last int, replacement string) (string, error) {
+	lines := splitLines(text)
+	if last == 0 {
+		last = len(lines)
+	}
+	if first > len(lines)+1 || last > len(lines) {
+		return "", fmt.Errorf("the file has only %d lines", len(lines))
+	}
+	var with []string
+	if replacement != "" {
+		with = splitLines(replacement)
+	}
+	result := append(append(append([]string{}, lines[:first-1]...), with...), lines[last:]...)
+	return joinLines(result, text == "" || strings.HasSuffix(text, "\n")), nil
+}
+
+// Lines on which find starts in text, each listed once
+func occurrenceLines(text, find string) []int {
+	var lines []int
+	for i, from := 0, 0; ; from = i + len(find) {
+		i = strings.Index(text[from:], find)
+		if i < 0 {
+			return lines
+		}
+		i += from
+		if line := strings.Count(text[:i], "\n") + 1; len(lines) == 0 || lines[len(lines)-1] != line {
+			lines = append(lines, line)
+		}
+	}
+}
+
+// Edit a text file in the workspace by unique search and replace, by
+// replacing a range of lines or by applying a unified diff. The edit is
+// logged as a ticket that keeps a backup for /file/revert.
+func editFile(w http.ResponseWriter, r *http.Request, session string) {
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+	decode := func(param string) ([]byte, error) {
+		data, err := base64.StdEncoding.DecodeString(r.URL.Query().Get(param))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode '%s': %v", param, err)
+		}
+		return data, nil
+	}
+	path, identity, err := workspaceTarget(session, r.URL.Query().Get("path"), elevated)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+
+	editMu.Lock()
+	defer editMu.Unlock()
+	before, err := readWorkspaceFile(session, path, int64(maxStdinBytes))
+	existed := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		writePlainMessage(w, fmt.Sprintf("Failed to read %s: %v", path, err))
+		return
+	}
+	if isBinary(before) {
+		writePlainMessage(w, fmt.Sprintf("%s is binary, replace it with /file/write instead", path))
+		return
+	}
+	text := string(before)
+
+	var after, input string
+	query := r.URL.Query()
+	switch {
+	case query.Get("b64patch") != "":
+		patch, err := decode("b64patch")
+		if err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		hunks, err := parsePatch(string(patch))
+		if err == nil {
+			after, err = applyPatch(text, hunks)
+		}
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to apply the patch to %s: %v", path, err))
+			return
+		}
+		input = fmt.Sprintf("patch %s with %d hunks", path, len(hunks))
+		if len(hunks) == 1 {
+			input = fmt.Sprintf("patch %s with 1 hunk", path)
+		}
+	case query.Get("lines") != "":
+		if !existed {
+			writePlainMessage(w, fmt.Sprintf("%s does not exist", path))
+			return
+		}
+		first, last, err := parseLineRange(query.Get("lines"))
+		if err != nil {
+			writePlainMessage(w, errRangeMessage)
+			return
+		}
+		if !query.Has("b64replace") {
+			writePlainMessage(w, "Missing 'b64replace' parameter, pass it empty to delete the lines")
+			return
+		}
+		replacement, err := decode("b64replace")
+		if err == nil {
+			after, err = replaceLines(text, first, last, string(replacement))
+		}
+		if err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to replace lines %s of %s: %v", query.Get("lines"), path, err))
+			return
+		}
+		input = fmt.Sprintf("replace lines %s of %s", query.Get("lines"), path)
+	case query.Get("b64find") != "":
+		if !existed {
+			writePlainMessage(w, fmt.Sprintf("%s does not exist", path))
+			return
+		}
+		find, err := decode("b64find")
+		if err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		replace, err := decode("b64replace")
+		if err != nil {
+			writePlainMessage(w, err.Error())
+			return
+		}
+		if len(find) == 0 {
+			writePlainMessage(w, "Invalid or missing 'b64find' parameter")
+			return
+		}
+		count := strings.Count(text, string(find))
+		if count == 0 {
+			writePlainMessage(w, fmt.Sprintf("'b64find' does not occur in %s. Read the file again, whitespace and indentation must match exactly.", path))
+			return
+		}
+		if count > 1 && query.Get("all") != "true" {
+			writePlainMessage(w, fmt.Sprintf("'b64find' occurs %d times in %s, on lines %s. Include more surrounding lines to make it unique, or set all=true to replace every occurrence.", count, path, joinTickets(occurrenceLines(text, string(find)))))
+			return
+		}
+		after = strings.ReplaceAll(text, string(find), string(replace))
+		input = fmt.Sprintf("replace %d occurrences in %s", count, path)
+		if count == 1 {
+			input = fmt.Sprintf("replace 1 occurrence in %s", path)
+		}
+	default:
+		writePlainMessage(w, "Missing 'b64find', 'lines' or 'b64patch' parameter")
+		return
+	}
+	if after == text && existed {
+		writePlainMessage(w, fmt.Sprintf("The edit leaves %s unchanged", path))
+		return
+	}
+	mode, err := queryMode(r, path)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	cer, err := commitEdit(r, session, path, identity, elevated, input, before, existed, []byte(after), true, mode)
+	if err != nil {
+		logger.Print(err)
+		writePlainMessage(w, err.Error())
+		return
+	}
+	writePlainCer(w, cer)
+}
+
+// Restore the file an edit ticket changed to its state before the edit.
+// The revert is an edit of its own and can be reverted in turn.
+func revertEdit(w http.ResponseWriter, r *http.Request, session string) {
+	ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+	if err != nil {
+		writePlainMessage(w, errTicketMessage)
+		return
+	}
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+	sessionFolder := filepath.Join(sessionsDir, session)
+	content, err := os.ReadFile(ticketEditPath(sessionFolder, ticket))
+	if err != nil {
+		writePlainMessage(w, fmt.Sprintf("Ticket %d is not a file edit", ticket))
+		return
+	}
+	var edit FileEdit
+	if err := json.Unmarshal(content, &edit); err != nil {
+		writePlainMessage(w, fmt.Sprintf("Failed to read the edit of ticket %d: %v", ticket, err))
+		return
+	}
+	var backup []byte
+	if edit.Existed {
+		if backup, err = os.ReadFile(ticketBackupPath(sessionFolder, ticket)); err != nil {
+			writePlainMessage(w, fmt.Sprintf("Failed to read the backup of ticket %d: %v", ticket, err))
+			return
+		}
+	}
+	path, identity, err := workspaceTarget(session, edit.Path, elevated)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+
+	editMu.Lock()
+	defer editMu.Unlock()
+	current, err := readWorkspaceFile(session, path, int64(maxStdinBytes))
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		writePlainMessage(w, fmt.Sprintf("Failed to read %s: %v", path, err))
+		return
+	}
+	// Refuse to throw away changes made after the edit
+	sum := sha256.Sum256(current)
+	if r.URL.Query().Get("force") != "true" && (exists != edit.Exists || (exists && hex.EncodeToString(sum[:]) != edit.SHA256)) {
+		writePlainMessage(w, fmt.Sprintf("%s changed since ticket %d edited it. Revert the later edits first, or set force=true to overwrite the changes.", path, ticket))
+		return
+	}
+	mode := edit.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	input := fmt.Sprintf("revert ticket %d on %s", ticket, path)
+	cer, err := commitEdit(r, session, path, identity, elevated, input, current, exists, backup, edit.Existed, mode)
+	if err != nil {
+		logger.Print(err)
+		writePlainMessage(w, err.Error())
+		return
+	}
+	writePlainCer(w, cer)
+}
+
+// Log an edit as a ticket, keep the previous content for a revert and write
+// the new content, or remove the file when it should no longer exist
+func commitEdit(r *http.Request, session, path string, identity *Identity, elevated bool, input string, before []byte, existed bool, after []byte, exists bool, mode os.FileMode) (*CmdResults, error) {
+	if exists && len(after) > len(before) {
+		if err := checkQuota(session, path, int64(len(after))); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	forest, err := newTicket(r, session, input, "", elevated)
+	if err != nil {
+		return nil, err
+	}
+	sessionFolder := forest.SessionFolder
+	edit := FileEdit{Path: path, Existed: existed, Exists: exists}
+	if existed {
+		if info, err := os.Stat(path); err == nil {
+			edit.Mode = info.Mode().Perm()
+		}
+	}
+	if exists {
+		sum := sha256.Sum256(after)
+		edit.SHA256 = hex.EncodeToString(sum[:])
+	}
+	cer := &CmdResults{
+		Type:     "edit",
+		Ticket:   forest.Ticket,
+		Session:  session,
+		Input:    input,
+		Elevated: elevated,
+		Next:     fmt.Sprintf("Undo this edit with %s/file/revert?hash=%s&session=%s&ticket=%d", fqdn, hashPassword, session, forest.Ticket),
+	}
+	if identity != nil {
+		cer.RunAs = identity.User
+	}
+
+	err = nil
+	if existed {
+		err = os.WriteFile(ticketBackupPath(sessionFolder, forest.Ticket), before, 0600)
+	}
+	if err == nil {
+		var record []byte
+		record, err = json.MarshalIndent(edit, "", "  ")
+		if err == nil {
+			err = os.WriteFile(ticketEditPath(sessionFolder, forest.Ticket), record, 0644)
+		}
+	}
+	if err == nil {
+		if exists {
+			err = writeWorkspaceFile(session, path, after, mode, identity)
+		} else {
+			err = removeWorkspaceFile(session, path)
+		}
+	}
+	if err != nil {
+		cer.ExitCode = 1
+		cer.Output = fmt.Sprintf("Failed to edit %s: %v", path, err)
+		cer.Next = "The file was not changed"
+		os.Remove(ticketEditPath(sessionFolder, forest.Ticket))
+	} else {
+		name := path
+		if rel, err := filepath.Rel(sessionWorkspace(session), path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+		oldName, newName := "a/"+name, "b/"+name
+		if !existed {
+			oldName = "/dev/null"
+		}
+		if !exists {
+			newName = "/dev/null"
+		}
+		cer.Output = unifiedDiff(oldName, newName, string(before), string(after))
+	}
+	cer.OutputBytes = int64(len(cer.Output))
+	cer.Duration = time.Since(start).String()
+
+	status := finishedStatus(cer)
+	cer.Status = strings.ToUpper(status)
+	writeTicket(session, forest.Ticket, makePlainCer(cer))
+	finishTicketMeta(cer, status)
+	// Tickets waiting on this one can run now
+	executor.Poke()
+	logger.Printf("FILE EDIT: %s : %d : %s : exit %d", session, forest.Ticket, input, cer.ExitCode)
+	return cer, nil
+}
+
+const (
+	treeDepth        = 3           // Default depth of /tree
+	treeLimit        = 200         // Default entries per page of /tree
+	maxTreeEntries   = 20000       // Entries walked before /tree gives up
+	searchLimit      = 100         // Default matches per page of /search
+	maxSearchMatches = 5000        // Matches collected before /search gives up
+	maxSearchEntries = 100000      // Entries walked before /search gives up
+	maxSearchFile    = 4 << 20     // Files larger than this are not searched
+	maxSearchLine    = 300         // Matched lines are cut to this many bytes
+	maxPageLimit     = 1000        // Most entries or matches on one page
+	searchReadBuffer = 1024 * 1024 // Longest line bufio reads while searching
+)
+
+// Directories skipped by /tree and /search unless 'ignore' says otherwise
+var defaultIgnore = []string{".git", "node_modules", "__pycache__", ".venv"}
+
+// Glob patterns of names to skip, the defaults unless 'ignore' was sent
+func queryIgnore(r *http.Request) []string {
+	if values, ok := r.URL.Query()["ignore"]; ok {
+		return splitList(strings.Join(values, ","))
+	}
+	return defaultIgnore
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Compact size like 512B, 4.0K or 12M
+func formatSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	size := float64(n)
+	for _, unit := range []string{"K", "M", "G", "T"} {
+		size /= 1024
+		if size < 1024 || unit == "T" {
+			if size < 10 {
+				return fmt.Sprintf("%.1f%s", size, unit)
+			}
+			return fmt.Sprintf("%.0f%s", size, unit)
+		}
+	}
+	return ""
+}
+
+// Show a workspace path relative to the workspace, the way agents pass it
+func workspaceName(session string, path string) string {
+	root, err := filepath.EvalSymlinks(sessionWorkspace(session))
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return rel
+}
+
+// Append the entries below dir of root to lines, indented by depth. Symlinks
+// are listed but not followed. Returns false once max lines were collected.
+func walkTree(root *os.Root, dir string, depth, maxDepth int, ignore []string, lines *[]string, max int) bool {
+	entries, err := fs.ReadDir(root.FS(), dir)
+	if err != nil {
+		*lines = append(*lines, fmt.Sprintf("%s[%v]", strings.Repeat("  ", depth), err))
+		return true
+	}
+	indent := strings.Repeat("  ", depth)
+	for _, entry := range entries {
+		if len(*lines) >= max {
+			return false
+		}
+		if matchesAny(ignore, entry.Name()) {
+			continue
+		}
+		full := filepath.Join(dir, entry.Name())
+		switch {
+		case entry.Type()&os.ModeSymlink != 0:
+			target, _ := root.Readlink(full)
+			*lines = append(*lines, fmt.Sprintf("%s%s -> %s", indent, entry.Name(), target))
+		case entry.IsDir():
+			if depth+1 >= maxDepth {
+				count := 0
+				if children, err := fs.ReadDir(root.FS(), full); err == nil {
+					count = len(children)
+				}
+				noun := "entries"
+				if count == 1 {
+					noun = "entry"
+				}
+				*lines = append(*lines, fmt.Sprintf("%s%s/ (%d %s)", indent, entry.Name(), count, noun))
+				continue
+			}
+			*lines = append(*lines, fmt.Sprintf("%s%s/", indent, entry.Name()))
+			if !walkTree(root, full, depth+1, maxDepth, ignore, lines, max) {
+				return false
+			}
+		default:
+			size := ""
+			if info, err := entry.Info(); err == nil {
+				size = formatSize(info.Size())
+			}
+			*lines = append(*lines, fmt.Sprintf("%s%s (%s)", indent, entry.Name(), size))
+		}
+	}
+	return true
+}
+
+// Read the shared parameters of /tree and /search, replying on failure
+func explorePage(w http.ResponseWriter, r *http.Request, def int) (string, string, int, int, bool) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet {
+		writePlainMessage(w, errMethodMessage)
+		return "", "", 0, 0, false
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return "", "", 0, 0, false
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return "", "", 0, 0, false
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "."
+	}
+	full, err := workspaceFile(session, path)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return "", "", 0, 0, false
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		writePlainMessage(w, errRangeMessage)
+		return "", "", 0, 0, false
+	}
+	limit, err := queryInt(r, "limit", def)
+	if err != nil || limit == 0 {
+		writePlainMessage(w, errRangeMessage)
+		return "", "", 0, 0, false
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return session, full, offset, limit, true
+}
+
+// Link to the next page of an exploring request, keeping its parameters
+func nextPage(r *http.Request, offset int) string {
+	query := r.URL.Query()
+	query.Set("offset", strconv.Itoa(offset))
+	return fmt.Sprintf("%s%s?%s", fqdn, r.URL.Path, query.Encode())
+}
+
+func treeHandler(w http.ResponseWriter, r *http.Request) {
+	session, full, offset, limit, ok := explorePage(w, r, treeLimit)
+	if !ok {
+		return
+	}
+	depth, err := queryInt(r, "depth", treeDepth)
+	if err != nil || depth == 0 {
+		writePlainMessage(w, errRangeMessage)
+		return
+	}
+	// Walk through a root, a command may swap a directory for a symlink
+	// while the tree is read
+	root, rel, err := workspaceRoot(session, full)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	defer root.Close()
+	info, err := root.Stat(rel)
+	if err != nil {
+		writePlainMessage(w, fmt.Sprintf("Failed to read %s: %v", full, err))
+		return
+	}
+	if !info.IsDir() {
+		writePlainMessage(w, fmt.Sprintf("%s is a file of %s, use /file/read to read it", full, formatSize(info.Size())))
+		return
+	}
+
+	var lines []string
+	complete := walkTree(root, rel, 0, depth, queryIgnore(r), &lines, maxTreeEntries)
+	if offset > len(lines) {
+		offset = len(lines)
+	}
+	end := offset + limit
+	if end > len(lines) {
+		end = len(lines)
+	}
+
+	res := fmt.Sprintf("HELLO LLM, HERE IS THE REQUESTED TREE!\n\n")
+	res += fmt.Sprintf("SESSION: %s\n\n", session)
+	res += fmt.Sprintf("PATH: %s\n\n", full)
+	res += fmt.Sprintf("DEPTH: %d\n\n", depth)
+	total := fmt.Sprintf("%d", len(lines))
+	if !complete {
+		total = fmt.Sprintf("more than %d, narrow 'path' or 'depth'", maxTreeEntries)
+	}
+	res += fmt.Sprintf("ENTRIES: %d-%d of %s\n\n", offset, end, total)
+	if end < len(lines) {
+		res += fmt.Sprintf("NEXT:\n\n%s\n\n", nextPage(r, end))
+	}
+	res += fmt.Sprintf("TREE:\n\n%s/\n", workspaceName(session, full))
+	for _, line := range lines[offset:end] {
+		res += fmt.Sprintf("  %s\n", line)
+	}
+	fmt.Fprint(w, res)
+}
+
+// What searchWalk found below a path
+type searchResult struct {
+	matches   []string
+	files     int  // Text files searched
+	skipped   int  // Files too large, unreadable or with a line too long
+	complete  bool // False once maxSearchMatches were collected
+	walkedAll bool // False once maxEntries were walked
+}
+
+// Search the text files below dir of root for re, walking at most maxEntries
+// entries. Matches name files relative to root.
+func searchWalk(root *os.Root, dir string, re *regexp.Regexp, globs []string, ignore []string, maxEntries int) *searchResult {
+	found := &searchResult{complete: true, walkedAll: true}
+	walked := 0
+	fs.WalkDir(root.FS(), dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if walked++; walked > maxEntries {
+			found.walkedAll = false
+			return fs.SkipAll
+		}
+		if path != dir && matchesAny(ignore, entry.Name()) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || (len(globs) > 0 && !matchesAny(globs, entry.Name())) {
+			return nil
+		}
+		file, info, err := openRegular(root, path)
+		if err != nil {
+			found.skipped++
+			return nil
+		}
+		defer file.Close()
+		if info.Size() > maxSearchFile {
+			found.skipped++
+			return nil
+		}
+		sample := make([]byte, binarySniffBytes)
+		n, _ := file.ReadAt(sample, 0)
+		if isBinary(sample[:n]) {
+			return nil
+		}
+		name := path
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), searchReadBuffer)
+		for line := 1; scanner.Scan(); line++ {
+			text := scanner.Text()
+			if !re.MatchString(text) {
+				continue
+			}
+			if len(text) > maxSearchLine {
+				text = text[:maxSearchLine] + " [...]"
+			}
+			found.matches = append(found.matches, fmt.Sprintf("%s:%d: %s", name, line, text))
+			if len(found.matches) >= maxSearchMatches {
+				found.files++
+				found.complete = false
+				return fs.SkipAll
+			}
+		}
+		// A line too long for the buffer ends the scan of its file
+		if scanner.Err() != nil {
+			found.skipped++
+			return nil
+		}
+		found.files++
+		return nil
+	})
+	return found
+}
+
+// Search the text files below a workspace path for a regular expression
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	session, full, offset, limit, ok := explorePage(w, r, searchLimit)
+	if !ok {
+		return
+	}
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		writePlainMessage(w, "Invalid or missing 'pattern' parameter")
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		writePlainMessage(w, fmt.Sprintf("Invalid 'pattern': %v", err))
+		return
+	}
+	globs := splitList(r.URL.Query().Get("glob"))
+	ignore := queryIgnore(r)
+
+	root, rel, err := workspaceRoot(session, full)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	defer root.Close()
+	found := searchWalk(root, rel, re, globs, ignore, maxSearchEntries)
+	matches := found.matches
+
+	if offset > len(matches) {
+		offset = len(matches)
+	}
+	end := offset + limit
+	if end > len(matches) {
+		end = len(matches)
+	}
+
+	res := fmt.Sprintf("HELLO LLM, HERE ARE THE SEARCH RESULTS!\n\n")
+	res += fmt.Sprintf("SESSION: %s\n\n", session)
+	res += fmt.Sprintf("PATH: %s\n\n", full)
+	res += fmt.Sprintf("PATTERN: %s\n\n", pattern)
+	res += fmt.Sprintf("FILES_SEARCHED: %d\n\n", found.files)
+	if found.skipped > 0 {
+		res += fmt.Sprintf("FILES_SKIPPED: %d (unreadable, larger than %s or with a line longer than %s)\n\n", found.skipped, formatSize(maxSearchFile), formatSize(searchReadBuffer))
+	}
+	total := fmt.Sprintf("%d", len(matches))
+	switch {
+	case !found.complete:
+		total = fmt.Sprintf("more than %d, narrow 'path', 'glob' or 'pattern'", maxSearchMatches)
+	case !found.walkedAll:
+		total = fmt.Sprintf("%d in the first %d entries walked, narrow 'path' or 'ignore'", len(matches), maxSearchEntries)
+	}
+	res += fmt.Sprintf("MATCHES: %d-%d of %s\n\n", offset, end, total)
+	if end < len(matches) {
+		res += fmt.Sprintf("NEXT:\n\n%s\n\n", nextPage(r, end))
+	}
+	res += fmt.Sprintf("RESULTS:\n\n")
+	for _, match := range matches[offset:end] {
+		res += fmt.Sprintf("%s\n", match)
+	}
+	fmt.Fprint(w, res)
+}
+
+const (
+	maxArtifactGlobs = 20  // Globs one ticket may name in 'artifacts'
+	maxArtifactFiles = 100 // Files kept per ticket
+)
+
+func ticketArtifactsPath(sessionFolder string, ticket int) string {
+	return filepath.Join(sessionFolder, fmt.Sprintf("%02d.artifacts", ticket))
+}
+
+// Read the comma separated 'artifacts' globs, nil when none were sent
+func queryArtifacts(r *http.Request) ([]string, error) {
+	globs := splitList(r.URL.Query().Get("artifacts"))
+	if len(globs) == 0 {
+		return nil, nil
+	}
+	if len(globs) > maxArtifactGlobs {
+		return nil, fmt.Errorf("Invalid 'artifacts' parameter, at most %d globs are allowed", maxArtifactGlobs)
+	}
+	for _, glob := range globs {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("Invalid 'artifacts' glob %q: %v", glob, err)
+		}
+	}
+	return globs, nil
+}
+
+// Copy the files matching the ticket's artifact globs into its artifacts
+// folder. Relative globs start in the workspace the command ran in, and
+// matched directories are copied whole. Unprivileged sessions may only
+// capture files in the workspace which their user can read.
+func captureArtifacts(session string, runner *Runnner) []Artifact {
+	dir := sessionWorkspace(session)
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		root = dir
+	}
+	// Only elevated tickets may keep files from outside the workspace, and
+	// never from the paths the sandbox hides, which hold HASH and every
+	// session's tickets
+	restricted := !runner.Elevated
+	var hidden []string
+	for _, path := range sandboxHiddenPaths() {
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			path = real
+		}
+		hidden = append(hidden, path)
+	}
+	dest := ticketArtifactsPath(runner.SessionFolder, runner.Ticket)
+	workspace, err := os.OpenRoot(root)
+	if err != nil {
+		return []Artifact{{Path: dir, Error: err.Error()}}
+	}
+	defer workspace.Close()
+
+	var artifacts []Artifact
+	seen := make(map[string]bool)
+	var total int64
+	add := func(path string) {
+		// Open first and check the file that was opened, a command may
+		// swap path or one of its directories for a symlink meanwhile.
+		// Restricted tickets open through the workspace root, which
+		// refuses to leave it.
+		var file *os.File
+		var err error
+		if restricted {
+			rel, relErr := filepath.Rel(dir, path)
+			if relErr != nil || !filepath.IsLocal(rel) {
+				artifacts = append(artifacts, Artifact{Path: path, Error: fmt.Sprintf("outside the workspace %s", dir)})
+				return
+			}
+			file, err = workspace.OpenFile(rel, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		} else {
+			file, err = os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		}
+		if err != nil {
+			if real, evalErr := filepath.EvalSymlinks(path); restricted && evalErr == nil && !pathWithin(real, root) {
+				err = fmt.Errorf("outside the workspace %s", dir)
+			}
+			artifacts = append(artifacts, Artifact{Path: path, Error: err.Error()})
+			return
+		}
+		defer file.Close()
+		real, err := openedPath(file, path)
+		if err != nil {
+			artifacts = append(artifacts, Artifact{Path: path, Error: err.Error()})
+			return
+		}
+		inside := pathWithin(real, root)
+		name := strings.TrimPrefix(real, string(filepath.Separator))
+		if inside {
+			name, _ = filepath.Rel(root, real)
+		}
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		info, err := file.Stat()
+		switch {
+		case err != nil:
+			artifacts = append(artifacts, Artifact{Path: path, Error: err.Error()})
+			return
+		case !info.Mode().IsRegular():
+			return
+		case restricted && !inside:
+			artifacts = append(artifacts, Artifact{Path: path, Error: fmt.Sprintf("outside the workspace %s", dir)})
+			return
+		case !inside && pathWithinAny(real, hidden):
+			artifacts = append(artifacts, Artifact{Path: path, Error: "in a directory hidden from sessions"})
+			return
+		case runner.Identity != nil && !identityCanRead(info, runner.Identity):
+			artifacts = append(artifacts, Artifact{Path: path, Error: fmt.Sprintf("not readable by %s", runner.Identity.User)})
+			return
+		case len(seen) > maxArtifactFiles:
+			artifacts = append(artifacts, Artifact{Path: path, Error: fmt.Sprintf("skipped, a ticket keeps at most %d artifacts", maxArtifactFiles)})
+			return
+		case total+info.Size() > artifactBytes:
+			artifacts = append(artifacts, Artifact{Path: path, Error: fmt.Sprintf("skipped, the ticket's artifacts would exceed %d bytes", artifactBytes)})
+			return
+		}
+		artifact, err := copyArtifact(file, filepath.Join(dest, name), artifactBytes-total)
+		if err != nil {
+			artifacts = append(artifacts, Artifact{Path: path, Error: err.Error()})
+			return
+		}
+		artifact.Path = path
+		artifact.Name = name
+		total += artifact.Bytes
+		artifacts = append(artifacts, artifact)
+	}
+
+	for _, glob := range runner.Artifacts {
+		pattern := glob
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, _ := filepath.Glob(pattern)
+		if len(matches) == 0 {
+			artifacts = append(artifacts, Artifact{Path: glob, Error: "no files matched"})
+			continue
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.IsDir() {
+				add(match)
+				continue
+			}
+			filepath.WalkDir(match, func(path string, entry os.DirEntry, err error) error {
+				if err == nil && entry.Type().IsRegular() {
+					add(path)
+				}
+				return nil
+			})
+		}
+	}
+	return artifacts
+}
+
+// Whether path is root or lies below it
+func pathWithin(path, root string) bool {
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func pathWithinAny(path string, roots []string) bool {
+	for _, root := range roots {
+		if pathWithin(path, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy at most max bytes of in to dst, returning its size and checksum
+func copyArtifact(in *os.File, dst string, max int64) (Artifact, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return Artifact{}, err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return Artifact{}, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, hash), io.LimitReader(in, max+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > max {
+		err = fmt.Errorf("skipped, the file grew past the artifact limit of %d bytes", artifactBytes)
+	}
+	if err != nil {
+		os.Remove(dst)
+		return Artifact{}, err
+	}
+	return Artifact{Bytes: n, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// Download an artifact of a ticket, or list them when no path is given
+func artifactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+
+	ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+	if err != nil {
+		writePlainMessage(w, errTicketMessage)
+		return
+	}
+	folder := ticketArtifactsPath(filepath.Join(sessionsDir, session), ticket)
+	if _, err := os.Stat(folder); err != nil {
+		writePlainMessage(w, fmt.Sprintf("Ticket %d has no artifacts", ticket))
+		return
+	}
+
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		res := fmt.Sprintf("HELLO LLM, HERE ARE THE ARTIFACTS OF TICKET %d!\n\n", ticket)
+		filepath.WalkDir(folder, func(path string, entry os.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() {
+				return nil
+			}
+			rel, _ := filepath.Rel(folder, path)
+			size := ""
+			if info, err := entry.Info(); err == nil {
+				size = formatSize(info.Size())
+			}
+			res += fmt.Sprintf("%s (%s)\n%s\n", rel, size, ArtifactLink(session, ticket, rel))
+			return nil
+		})
+		fmt.Fprint(w, res)
+		return
+	}
+
+	// Names are relative to the artifacts folder and cannot leave it
+	path := filepath.Join(folder, filepath.Clean(string(filepath.Separator)+name))
+	file, err := os.Open(path)
+	if err != nil {
+		writePlainMessage(w, fmt.Sprintf("Ticket %d has no artifact %s", ticket, name))
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		writePlainMessage(w, fmt.Sprintf("Ticket %d has no artifact %s", ticket, name))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
+}
+
+const (
+	snapshotsFolder   = "snapshots"
+	maxSnapshotFiles  = 50000     // Entries recorded per snapshot
+	maxSnapshotPatch  = 64 * 1024 // Bytes of diffs shown by /snapshot/diff
+	snapshotInputSize = 100       // Characters of the ticket's input kept with its snapshot
+)
+
+// SnapshotEntry is a file, directory or symlink in a workspace snapshot.
+// File contents live in the session's object store under their sha256.
+type SnapshotEntry struct {
+	Type    string      `json:"type"` // "file", "dir" or "symlink"
+	Mode    os.FileMode `json:"mode"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime int64       `json:"mtime,omitempty"` // Lets the next snapshot reuse the hash
+	SHA256  string      `json:"sha256,omitempty"`
+	Target  string      `json:"target,omitempty"`
+	Skipped bool        `json:"skipped,omitempty"` // Too large to keep, restores leave it alone
+}
+
+// Snapshot is the state of a session workspace before a ticket ran
+type Snapshot struct {
+	Ticket    int                       `json:"ticket"`
+	Input     string                    `json:"input"`
+	Created   time.Time                 `json:"created"`
+	Files     int                       `json:"files"`
+	Bytes     int64                     `json:"bytes"`
+	Skipped   int                       `json:"skipped,omitempty"`
+	Truncated bool                      `json:"truncated,omitempty"`
+	Entries   map[string]*SnapshotEntry `json:"entries"`
+}
+
+// Snapshots and restores of a session hold its lock, which keeps the
+// session's object store consistent while unreferenced objects are removed.
+// Sessions have their own stores, so hashing one workspace never holds up
+// the tickets of another.
+var snapshotLocks = struct {
+	sync.Mutex
+	sessions map[string]*sync.Mutex
+}{sessions: make(map[string]*sync.Mutex)}
+
+func snapshotLock(session string) *sync.Mutex {
+	snapshotLocks.Lock()
+	defer snapshotLocks.Unlock()
+	lock := snapshotLocks.sessions[session]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		snapshotLocks.sessions[session] = lock
+	}
+	return lock
+}
+
+func snapshotPath(sessionFolder string, ticket int) string {
+	return filepath.Join(sessionFolder, snapshotsFolder, fmt.Sprintf("%02d.json", ticket))
+}
+
+func objectPath(sessionFolder string, sum string) string {
+	return filepath.Join(sessionFolder, snapshotsFolder, "objects", sum[:2], sum)
+}
+
+func snapshotLink(action string, session string) string {
+	return fmt.Sprintf("%s/snapshot/%s?hash=%s&session=%s", fqdn, action, hashPassword, session)
+}
+
+func loadSnapshot(sessionFolder string, ticket int) (*Snapshot, error) {
+	data, err := os.ReadFile(snapshotPath(sessionFolder, ticket))
+	if err != nil {
+		return nil, fmt.Errorf("No snapshot was taken before ticket %d", ticket)
+	}
+	snap := &Snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, fmt.Errorf("Failed to read the snapshot of ticket %d: %v", ticket, err)
+	}
+	return snap, nil
+}
+
+// Tickets that have a snapshot, oldest first
+func snapshotTickets(sessionFolder string) []int {
+	files, _ := filepath.Glob(filepath.Join(sessionFolder, snapshotsFolder, "*.json"))
+	tickets := make([]int, 0, len(files))
+	for _, file := range files {
+		if ticket, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".json")); err == nil {
+			tickets = append(tickets, ticket)
+		}
+	}
+	sort.Ints(tickets)
+	return tickets
+}
+
+// Copy a workspace file into the object store, returning its sha256
+func storeObject(sessionFolder string, root *os.Root, path string) (string, error) {
+	in, _, err := openRegular(root, path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	dir := filepath.Join(sessionFolder, snapshotsFolder, "objects")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, "incoming-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	object := objectPath(sessionFolder, sum)
+	if _, err := os.Stat(object); err == nil {
+		return sum, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(object), 0700); err != nil {
+		return "", err
+	}
+	return sum, os.Rename(tmp.Name(), object)
+}
+
+func hashFile(root *os.Root, path string) (string, error) {
+	in, _, err := openRegular(root, path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Walk the session workspace into a snapshot. With store the contents of
+// new files are added to the object store. Files that kept their size and
+// modification time since prev reuse its hash instead of being read again.
+// The walk goes through a root, so a command swapping a directory for a
+// symlink meanwhile cannot lead it out of the workspace.
+func scanWorkspace(session string, sessionFolder string, prev *Snapshot, store bool) (*Snapshot, error) {
+	snap := &Snapshot{Created: time.Now(), Entries: make(map[string]*SnapshotEntry)}
+	root, err := os.OpenRoot(sessionWorkspace(session))
+	if os.IsNotExist(err) {
+		return snap, nil
+	}
+	if err != nil {
+		return snap, err
+	}
+	defer root.Close()
+	err = fs.WalkDir(root.FS(), ".", func(rel string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if len(snap.Entries) >= maxSnapshotFiles {
+			snap.Truncated = true
+			return fs.SkipAll
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		item := &SnapshotEntry{Mode: info.Mode().Perm()}
+		switch {
+		case entry.IsDir():
+			item.Type = "dir"
+		case entry.Type()&os.ModeSymlink != 0:
+			item.Type = "symlink"
+			item.Target, _ = root.Readlink(rel)
+		case entry.Type().IsRegular():
+			item.Type = "file"
+			item.Size = info.Size()
+			item.ModTime = info.ModTime().UnixNano()
+			snap.Files++
+			snap.Bytes += item.Size
+			if item.Size > snapshotMaxFile {
+				item.Skipped = true
+				snap.Skipped++
+				break
+			}
+			if old := prev.entry(rel); old != nil && old.Type == "file" && !old.Skipped && old.Size == item.Size && old.ModTime == item.ModTime {
+				if _, err := os.Stat(objectPath(sessionFolder, old.SHA256)); !store || err == nil {
+					item.SHA256 = old.SHA256
+					break
+				}
+			}
+			if store {
+				item.SHA256, err = storeObject(sessionFolder, root, rel)
+			} else {
+				item.SHA256, err = hashFile(root, rel)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", rel, err)
+			}
+		default:
+			// Sockets, pipes and devices are not kept
+			return nil
+		}
+		snap.Entries[rel] = item
+		return nil
+	})
+	return snap, err
+}
+
+func (s *Snapshot) entry(path string) *SnapshotEntry {
+	if s == nil {
+		return nil
+	}
+	return s.Entries[path]
+}
+
+// Store a snapshot and drop the oldest ones beyond SNAPSHOT_KEEP together
+// with the objects no remaining snapshot, nor pinned, refers to
+func saveSnapshot(sessionFolder string, snap *Snapshot, pinned *Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	path := snapshotPath(sessionFolder, snap.Ticket)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	tickets := snapshotTickets(sessionFolder)
+	if len(tickets) <= snapshotKeep {
+		return nil
+	}
+	for _, ticket := range tickets[:len(tickets)-snapshotKeep] {
+		os.Remove(snapshotPath(sessionFolder, ticket))
+	}
+	used := make(map[string]bool)
+	if pinned != nil {
+		for _, item := range pinned.Entries {
+			used[item.SHA256] = true
+		}
+	}
+	for _, ticket := range tickets[len(tickets)-snapshotKeep:] {
+		kept, err := loadSnapshot(sessionFolder, ticket)
+		if err != nil {
+			// Removing objects of a snapshot that cannot be read would break it for good
+			return nil
+		}
+		for _, item := range kept.Entries {
+			used[item.SHA256] = true
+		}
+	}
+	objects, _ := filepath.Glob(filepath.Join(sessionFolder, snapshotsFolder, "objects", "*", "*"))
+	for _, object := range objects {
+		if !used[filepath.Base(object)] {
+			os.Remove(object)
+		}
+	}
+	return nil
+}
+
+// Snapshot the workspace before a ticket runs, returning the summary the
+// ticket reports
+func snapshotTicket(session string, sessionFolder string, ticket int, input string) string {
+	lock := snapshotLock(session)
+	lock.Lock()
+	defer lock.Unlock()
+	summary, _ := takeSnapshot(session, sessionFolder, ticket, input, nil)
+	return summary
+}
+
+// takeSnapshot does the work of snapshotTicket with the session's lock held. The
+// objects of pinned survive pruning, so a restore can still read them.
+func takeSnapshot(session string, sessionFolder string, ticket int, input string, pinned *Snapshot) (string, *Snapshot) {
+	if err := os.MkdirAll(filepath.Join(sessionFolder, snapshotsFolder), 0700); err != nil {
+		return fmt.Sprintf("failed: %v", err), nil
+	}
+	var prev *Snapshot
+	if tickets := snapshotTickets(sessionFolder); len(tickets) > 0 {
+		prev, _ = loadSnapshot(sessionFolder, tickets[len(tickets)-1])
+	}
+	snap, err := scanWorkspace(session, sessionFolder, prev, true)
+	if err != nil {
+		logger.Printf("Failed to snapshot workspace of %s: %v", session, err)
+		return fmt.Sprintf("failed: %v", err), nil
+	}
+	snap.Ticket = ticket
+	snap.Input = strings.SplitN(input, "\n", 2)[0]
+	if len(snap.Input) > snapshotInputSize {
+		snap.Input = snap.Input[:snapshotInputSize] + "..."
+	}
+	if err := saveSnapshot(sessionFolder, snap, pinned); err != nil {
+		logger.Printf("Failed to save snapshot of %s: %v", session, err)
+		return fmt.Sprintf("failed: %v", err), nil
+	}
+	summary := fmt.Sprintf("%d files, %s", snap.Files, formatSize(snap.Bytes))
+	if snap.Skipped > 0 {
+		summary += fmt.Sprintf(", %d too large to keep", snap.Skipped)
+	}
+	if snap.Truncated {
+		summary += fmt.Sprintf(", stopped after %d entries", maxSnapshotFiles)
+	}
+	summary = fmt.Sprintf("%s. See what this ticket changed at %s&from=%d, or undo it with %s&ticket=%d", summary, snapshotLink("diff", session), ticket, snapshotLink("restore", session), ticket)
+	return summary, snap
+}
+
+const (
+	maxFileChanges   = 200 // Changes listed in a ticket
+	fileScanComplete = "complete"
+	fileScanShared   = "other work in the session ran meanwhile, some changes may be its"
+)
+
+// ActivityTracker counts the work under way in each session, tickets, jobs,
+// watches and file writes alike, so a ticket can tell whether its
+// FILE_CHANGES may include what something else did
+type ActivityTracker struct {
+	mu      sync.Mutex
+	running map[string]int
+	started map[string]uint64 // Work begun in the session so far
+}
+
+var activity = &ActivityTracker{running: make(map[string]int), started: make(map[string]uint64)}
+
+// activityMark is one unit of work, from Begin to End
+type activityMark struct {
+	session string
+	started uint64
+	busy    bool // Other work was under way when it began
+}
+
+func (a *ActivityTracker) Begin(session string) *activityMark {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	mark := &activityMark{session: session, busy: a.running[session] > 0}
+	a.running[session]++
+	a.started[session]++
+	mark.started = a.started[session]
+	return mark
+}
+
+// Whether any other work in the session ran since the mark began
+func (a *ActivityTracker) Overlapped(mark *activityMark) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return mark.busy || a.running[mark.session] > 1 || a.started[mark.session] != mark.started
+}
+
+func (a *ActivityTracker) End(mark *activityMark) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running[mark.session]--; a.running[mark.session] == 0 {
+		delete(a.running, mark.session)
+		delete(a.started, mark.session)
+	}
+}
+
+// Record the type, size and modification time of everything below root
+// under the key name returns, without reading any file. Symlinks are not
+// followed and unreadable directories are left out.
+func statTree(snap *Snapshot, root string, name func(path string) string) {
+	filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		key := name(path)
+		if key == "" {
+			return nil
+		}
+		if len(snap.Entries) >= changeScanEntries {
+			snap.Truncated = true
+			return filepath.SkipAll
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		item := &SnapshotEntry{Mode: info.Mode().Perm()}
+		switch {
+		case entry.IsDir():
+			item.Type = "dir"
+		case entry.Type()&os.ModeSymlink != 0:
+			item.Type = "symlink"
+			item.Target, _ = os.Readlink(path)
+		case entry.Type().IsRegular():
+			item.Type = "file"
+			item.Size = info.Size()
+			item.ModTime = info.ModTime().UnixNano()
+		default:
+			return nil
+		}
+		snap.Entries[key] = item
+		return nil
+	})
+}
+
+// Scan the session workspace, keyed by relative path, and WATCH_PATHS,
+// keyed by absolute path, so the scans before and after a ticket show what
+// it changed. Returns nil when CHANGE_SCAN_ENTRIES turned tracking off.
+func scanChanges(session string) *Snapshot {
+	if changeScanEntries <= 0 {
+		return nil
+	}
+	snap := &Snapshot{Created: time.Now(), Entries: make(map[string]*SnapshotEntry)}
+	root := sessionWorkspace(session)
+	statTree(snap, root, func(path string) string {
+		if path == root {
+			return ""
+		}
+		rel, _ := filepath.Rel(root, path)
+		return rel
+	})
+	for _, watched := range watchPaths {
+		statTree(snap, watched, func(path string) string { return path })
+	}
+	return snap
+}
+
+// FileChange is a path that differs between two snapshots or scans
+type FileChange struct {
+	Op   string `json:"op"` // "A" created, "M" modified or "D" deleted
+	Path string `json:"path"`
+	Note string `json:"note"` // Sizes, or what else changed
+}
+
+// Describe an added or deleted entry
+func entryNote(item *SnapshotEntry) string {
+	switch item.Type {
+	case "file":
+		return formatSize(item.Size)
+	case "symlink":
+		return "-> " + item.Target
+	}
+	return item.Type
+}
+
+// Compare two snapshots. Files without a hash, from a scan or too large to
+// keep, count as modified when their size or modification time changed.
+func diffSnapshots(from, to *Snapshot) []FileChange {
+	paths := make([]string, 0, len(from.Entries)+len(to.Entries))
+	for path := range from.Entries {
+		paths = append(paths, path)
+	}
+	for path := range to.Entries {
+		if from.Entries[path] == nil {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []FileChange
+	for _, path := range paths {
+		a, b := from.Entries[path], to.Entries[path]
+		switch {
+		case a == nil:
+			changes = append(changes, FileChange{Op: "A", Path: path, Note: entryNote(b)})
+		case b == nil:
+			changes = append(changes, FileChange{Op: "D", Path: path, Note: entryNote(a)})
+		case a.Type != b.Type:
+			changes = append(changes, FileChange{Op: "M", Path: path, Note: fmt.Sprintf("%s -> %s", a.Type, b.Type)})
+		case a.Type == "dir":
+			if a.Mode != b.Mode {
+				changes = append(changes, FileChange{Op: "M", Path: path, Note: fmt.Sprintf("mode %04o -> %04o", a.Mode, b.Mode)})
+			}
+		case a.Type == "symlink":
+			if a.Target != b.Target {
+				changes = append(changes, FileChange{Op: "M", Path: path, Note: fmt.Sprintf("-> %s", b.Target)})
+			}
+		case a.SHA256 != b.SHA256 || a.Size != b.Size || ((a.SHA256 == "" || b.SHA256 == "") && a.ModTime != b.ModTime):
+			changes = append(changes, FileChange{Op: "M", Path: path, Note: fmt.Sprintf("%s -> %s", formatSize(a.Size), formatSize(b.Size))})
+		case a.Mode != b.Mode:
+			changes = append(changes, FileChange{Op: "M", Path: path, Note: fmt.Sprintf("mode %04o -> %04o", a.Mode, b.Mode)})
+		}
+	}
+	return changes
+}
+
+func formatChanges(changes []FileChange) string {
+	var b strings.Builder
+	for _, change := range changes {
+		fmt.Fprintf(&b, "%s %s (%s)\n", change.Op, change.Path, change.Note)
+	}
+	return b.String()
+}
+
+// Content of a snapshot entry as text for a diff, empty for anything that
+// is not a kept text file
+func snapshotText(session string, sessionFolder string, item *SnapshotEntry, path string, live bool) (string, bool) {
+	if item == nil {
+		return "", true
+	}
+	if item.Type != "file" || item.Skipped {
+		return "", false
+	}
+	var data []byte
+	var err error
+	if live {
+		data, err = readLiveFile(session, path, snapshotMaxFile)
+	} else {
+		data, err = os.ReadFile(objectPath(sessionFolder, item.SHA256))
+	}
+	if err != nil || isBinary(data) {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Read a file of at most max bytes from the live workspace, see openRegular
+func readLiveFile(session string, path string, max int64) ([]byte, error) {
+	root, err := os.OpenRoot(sessionWorkspace(session))
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	file, info, err := openRegular(root, path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if info.Size() > max {
+		return nil, fmt.Errorf("%s is larger than %s", path, formatSize(max))
+	}
+	return io.ReadAll(io.LimitReader(file, max))
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != http.MethodGet {
+		writePlainMessage(w, errMethodMessage)
+		return
+	}
+
+	// Validate the hash parameter
+	hashParam := r.URL.Query().Get("hash")
+	if subtle.ConstantTimeCompare([]byte(hashParam), []byte(hashPassword)) != 1 {
+		writePlainMessage(w, errHashMessage)
+		return
+	}
+
+	// Check if session is provided in query parameters
+	session := r.URL.Query().Get("session")
+	if !validSession(session) {
+		writePlainMessage(w, errSessionMessage)
+		return
+	}
+	sessionFolder := filepath.Join(sessionsDir, session)
+	if exists, _ := store.SessionExists(session); !exists {
+		writePlainMessage(w, fmt.Sprintf("Session %s does not exist", session))
+		return
+	}
+
+	action := strings.TrimPrefix(r.URL.Path, "/snapshot/")
+	switch action {
+	case "list":
+		cfg, _ := loadSessionConfig(sessionFolder)
+		res := fmt.Sprintf("HELLO LLM, HERE ARE THE SNAPSHOTS OF YOUR WORKSPACE!\n\n")
+		res += fmt.Sprintf("SESSION: %s\n\n", session)
+		res += fmt.Sprintf("ENABLED: %v\n\n", sessionSnapshots(cfg))
+		res += fmt.Sprintf("Each snapshot is the workspace as it was before the ticket ran. Diff one against the workspace with %s&from=TICKET and roll back with %s&ticket=TICKET.\n\n", snapshotLink("diff", session), snapshotLink("restore", session))
+		res += fmt.Sprintf("SNAPSHOTS:\n\n")
+		tickets := snapshotTickets(sessionFolder)
+		for i := len(tickets) - 1; i >= 0; i-- {
+			snap, err := loadSnapshot(sessionFolder, tickets[i])
+			if err != nil {
+				res += fmt.Sprintf("TICKET %02d: %v\n", tickets[i], err)
+				continue
+			}
+			res += fmt.Sprintf("TICKET %02d  %s  %d files, %s  %s\n", snap.Ticket, snap.Created.Format(time.RFC3339), snap.Files, formatSize(snap.Bytes), snap.Input)
+		}
+		if len(tickets) == 0 {
+			res += fmt.Sprintf("None yet. Enable them with %s/session?hash=%s&name=%s&snapshots=true\n", fqdn, hashPassword, session)
+		}
+		fmt.Fprint(w, res)
+	case "diff":
+		diffSnapshot(w, r, session, sessionFolder)
+	case "restore":
+		restoreSnapshot(w, r, session, sessionFolder)
+	default:
+		writePlainMessage(w, fmt.Sprintf("Unknown snapshot action: %s", action))
+	}
+}
+
+// Compare the snapshot before ticket 'from' with the one before 'to', or
+// with the workspace as it is now
+func diffSnapshot(w http.ResponseWriter, r *http.Request, session string, sessionFolder string) {
+	fromTicket, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		writePlainMessage(w, "Invalid or missing 'from' parameter")
+		return
+	}
+	from, err := loadSnapshot(sessionFolder, fromTicket)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	var to *Snapshot
+	toName := "the workspace now"
+	live := r.URL.Query().Get("to") == ""
+	if live {
+		to, err = scanWorkspace(session, sessionFolder, from, false)
+	} else {
+		toTicket, convErr := strconv.Atoi(r.URL.Query().Get("to"))
+		if convErr != nil {
+			writePlainMessage(w, "Invalid 'to' parameter")
+			return
+		}
+		to, err = loadSnapshot(sessionFolder, toTicket)
+		toName = fmt.Sprintf("before ticket %d", toTicket)
+	}
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+	changes := diffSnapshots(from, to)
+
+	res := fmt.Sprintf("HELLO LLM, HERE ARE THE WORKSPACE CHANGES!\n\n")
+	res += fmt.Sprintf("SESSION: %s\n\n", session)
+	res += fmt.Sprintf("FROM: before ticket %d\n\n", fromTicket)
+	res += fmt.Sprintf("TO: %s\n\n", toName)
+	res += fmt.Sprintf("CHANGES: %d\n\n", len(changes))
+	if len(changes) > 0 {
+		res += fmt.Sprintf("%s\n", formatChanges(changes))
+	}
+	if r.URL.Query().Get("patch") == "true" && len(changes) > 0 {
+		var patch strings.Builder
+		for _, change := range changes {
+			a, aText := snapshotText(session, sessionFolder, from.Entries[change.Path], change.Path, false)
+			b, bText := snapshotText(session, sessionFolder, to.Entries[change.Path], change.Path, live)
+			if !aText || !bText {
+				continue
+			}
+			oldName, newName := "a/"+change.Path, "b/"+change.Path
+			if change.Op == "A" {
+				oldName = "/dev/null"
+			}
+			if change.Op == "D" {
+				newName = "/dev/null"
+			}
+			diff := unifiedDiff(oldName, newName, a, b)
+			if patch.Len()+len(diff) > maxSnapshotPatch {
+				patch.WriteString(fmt.Sprintf("[... diffs cut at %s, narrow them with /file/read ...]\n", formatSize(maxSnapshotPatch)))
+				break
+			}
+			patch.WriteString(diff)
+		}
+		res += fmt.Sprintf("PATCH:\n\n%s\n", patch.String())
+	}
+	fmt.Fprint(w, res)
+}
+
+// Roll the workspace back to its snapshot before a ticket. The restore is
+// logged as a ticket of its own, whose snapshot holds the state it replaced.
+func restoreSnapshot(w http.ResponseWriter, r *http.Request, session string, sessionFolder string) {
+	ticket, err := strconv.Atoi(r.URL.Query().Get("ticket"))
+	if err != nil {
+		writePlainMessage(w, errTicketMessage)
+		return
+	}
+	elevated := r.URL.Query().Get("elevate") == "true"
+	if elevated && !canElevate(session) {
+		logger.Printf("Denied elevation for session %s", session)
+		writePlainMessage(w, errElevateMessage)
+		return
+	}
+	target, err := loadSnapshot(sessionFolder, ticket)
+	if err != nil {
+		writePlainMessage(w, err.Error())
+		return
+	}
+
+	start := time.Now()
+	input := fmt.Sprintf("restore the workspace to before ticket %d", ticket)
+	forest, err := newTicket(r, session, input, "", elevated)
+	if err != nil {
+		logger.Print(err)
+		writePlainMessage(w, err.Error())
+		return
+	}
+	cer := &CmdResults{
+		Type:     "restore",
+		Ticket:   forest.Ticket,
+		Session:  session,
+		Input:    input,
+		Elevated: elevated,
+		Next:     fmt.Sprintf("Undo this restore with %s&ticket=%d", snapshotLink("restore", session), forest.Ticket),
+	}
+	if forest.Identity != nil {
+		cer.RunAs = forest.Identity.User
+	}
+
+	// The state being replaced is snapshotted first so the restore can be undone
+	lock := snapshotLock(session)
+	lock.Lock()
+	summary, current := takeSnapshot(session, sessionFolder, forest.Ticket, input, target)
+	cer.Snapshot = summary
+	if current == nil {
+		err = fmt.Errorf("the workspace could not be snapshotted first")
+	} else {
+		err = applySnapshot(session, sessionFolder, current, target, forest.Identity)
+	}
+	lock.Unlock()
+	if err != nil && current == nil {
+		cer.ExitCode = 1
+		cer.Output = fmt.Sprintf("Failed to restore the workspace: %v", err)
+		cer.Next = "The workspace was not changed"
+	} else if err != nil {
+		cer.ExitCode = 1
+		cer.Output = fmt.Sprintf("Failed to restore the workspace: %v", err)
+		cer.Next = fmt.Sprintf("The workspace may be partly restored. Its state before this restore is kept, roll back to it with %s&ticket=%d", snapshotLink("restore", session), forest.Ticket)
+	} else {
+		cer.Output = formatChanges(diffSnapshots(current, target))
+		if cer.Output == "" {
+			cer.Output = "The workspace already matched the snapshot"
+		}
+	}
+	cer.OutputBytes = int64(len(cer.Output))
+	cer.Duration = time.Since(start).String()
+
+	status := finishedStatus(cer)
+	cer.Status = strings.ToUpper(status)
+	writeTicket(session, forest.Ticket, makePlainCer(cer))
+	finishTicketMeta(cer, status)
+	executor.Poke()
+	logger.Printf("SNAPSHOT RESTORE: %s : %d : ticket %d : exit %d", session, forest.Ticket, ticket, cer.ExitCode)
+	writePlainCer(w, cer)
+}
+
+// Make the workspace, currently described by current, match target. Files
+// too large for the snapshot are left as they are.
+func applySnapshot(session string, sessionFolder string, current, target *Snapshot, id *Identity) error {
+	defer activity.End(activity.Begin(session))
+	if _, err := ensureWorkspace(session, id); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(sessionWorkspace(session))
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	// Remove what the target lacks or holds as another type, deepest first
+	paths := make([]string, 0, len(current.Entries))
+	for path := range current.Entries {
+		paths = append(paths, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		want := target.Entries[path]
+		if want != nil && (want.Type == current.Entries[path].Type || want.Skipped) {
+			continue
+		}
+		if err := root.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	// Parents sort before their children
+	paths = paths[:0]
+	for path := range target.Entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		want, have := target.Entries[path], current.Entries[path]
+		if want.Skipped || strings.HasPrefix(path, "..") || filepath.IsAbs(path) {
+			continue
+		}
+		// Only the parent is resolved, a link in the way is replaced rather
+		// than followed to its target
+		parent, err := workspaceFile(session, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		full := filepath.Join(parent, filepath.Base(path))
+		switch want.Type {
+		case "dir":
+			if err := mkdirAllOwned(root, path, id); err != nil {
+				return err
+			}
+			if err := root.Chmod(path, want.Mode); err != nil {
+				return err
+			}
+		case "symlink":
+			if have != nil && have.Type == "symlink" && have.Target == want.Target {
+				continue
+			}
+			root.Remove(path)
+			if err := root.Symlink(want.Target, path); err != nil {
+				return err
+			}
+			if id != nil {
+				root.Lchown(path, int(id.UID), int(id.GID))
+			}
+		case "file":
+			if have != nil && have.Type == "file" && have.SHA256 == want.SHA256 && have.Mode == want.Mode {
+				continue
+			}
+			data, err := os.ReadFile(objectPath(sessionFolder, want.SHA256))
+			if err != nil {
+				return fmt.Errorf("the content of %s is missing from the snapshot store: %v", path, err)
+			}
+			if err := writeWorkspaceFile(session, full, data, want.Mode, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
@@ -1,7 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -120,4 +134,1582 @@ func TestSessionIsolation(t *testing.T) {
 	}
 }
 
+// Session user names must be valid, bounded and distinct for distinct sessions
+func TestSessionUserName(t *testing.T) {
+	runAsPrefix = "llmass-"
+
+	if name := sessionUserName("build"); name != "llmass-build" {
+		t.Errorf("Expected llmass-build, got %s", name)
+	}
+
+	long := sessionUserName("a-very-long-session-name-that-exceeds-the-limit")
+	if len(long) > 32 {
+		t.Errorf("User name %s is longer than 32 characters", long)
+	}
+
+	if sessionUserName("My Session") == sessionUserName("mysession") {
+		t.Error("Sanitized session names collided")
+	}
+}
+
+func TestValidSession(t *testing.T) {
+	for session, want := range map[string]bool{
+		"build":                 true,
+		"My_Session-2":          true,
+		strings.Repeat("a", 64): true,
+		"":                      false,
+		strings.Repeat("a", 65): false,
+		"..":                    false,
+		"../sessions":           false,
+		"a/b":                   false,
+		"a.b":                   false,
+		"a b":                   false,
+	} {
+		if got := validSession(session); got != want {
+			t.Errorf("validSession(%q) = %v, want %v", session, got, want)
+		}
+	}
+
+	hashPassword = "0123456789abcdef0123456789abcdef"
+	w := httptest.NewRecorder()
+	shellHandler(w, httptest.NewRequest("GET", "/shell?hash="+hashPassword+"&session=..%2Fsessions&cmd=id", nil))
+	if !strings.Contains(w.Body.String(), errSessionMessage) {
+		t.Errorf("a session name with a separator got %q", w.Body.String())
+	}
+}
+
+func TestLookupIdentityRejectsRoot(t *testing.T) {
+	if _, err := lookupIdentity("0:0"); err == nil {
+		t.Error("Expected uid 0 to be rejected")
+	}
+
+	id, err := lookupIdentity("65534:65534")
+	if err != nil {
+		t.Fatalf("Failed to look up numeric identity: %v", err)
+	}
+	if id.UID != 65534 || id.GID != 65534 {
+		t.Errorf("Unexpected identity %d:%d", id.UID, id.GID)
+	}
+}
+
+func TestSandboxHiddenPaths(t *testing.T) {
+	sessionsDir = "sessions"
+	sandboxHide = []string{"/host"}
+
+	hidden := sandboxHiddenPaths()
+	if len(hidden) != 3 || hidden[2] != "/host" {
+		t.Errorf("Unexpected hidden paths: %v", hidden)
+	}
+	for _, path := range hidden {
+		if !filepath.IsAbs(path) {
+			t.Errorf("Hidden path %s is not absolute", path)
+		}
+	}
+}
+
+// Root inside a sandbox could undo its mounts or read the server's environment
+func TestSandboxNeedsIdentity(t *testing.T) {
+	workspacesDir = t.TempDir()
+	runner := &Runnner{Config: &SessionConfig{Sandbox: sandboxNamespace}}
+	if _, err := buildCommand(context.Background(), "root", runner, "true"); err == nil {
+		t.Error("a namespace sandbox without a session user was allowed")
+	}
+	runner.Config.Sandbox = sandboxLandlock
+	if _, err := buildCommand(context.Background(), "root", runner, "true"); err == nil {
+		t.Error("a landlock sandbox without a session user was allowed")
+	}
+	runner.Elevated = true
+	if _, err := buildCommand(context.Background(), "root", runner, "true"); err != nil {
+		t.Errorf("an elevated ticket was refused: %v", err)
+	}
+}
+
+// Hidden paths are carved out of the read roots by listing their siblings
+func TestLandlockReadRoots(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"app/sessions", "app/src", "etc", "usr/bin"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roots, err := landlockReadRoots(dir, []string{filepath.Join(dir, "app", "sessions")})
+	if err != nil {
+		t.Fatalf("Failed to compute read roots: %v", err)
+	}
+	expected := []string{filepath.Join(dir, "app", "src"), filepath.Join(dir, "etc"), filepath.Join(dir, "usr")}
+	if strings.Join(roots, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, roots)
+	}
+
+	roots, err = landlockReadRoots(dir, nil)
+	if err != nil || len(roots) != 1 || roots[0] != dir {
+		t.Errorf("Expected only %s without hidden paths, got %v (%v)", dir, roots, err)
+	}
+}
+
+func TestCappedOutput(t *testing.T) {
+	disk, err := os.Create(filepath.Join(t.TempDir(), "01.output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	capture := newCappedOutput(disk, 4, 4, 1024)
+	for _, chunk := range []string{"01", "23456", "789", "abcdef"} {
+		capture.Write([]byte(chunk))
+	}
+
+	if !capture.Truncated() {
+		t.Error("Expected output to be truncated")
+	}
+	if capture.Total() != 16 {
+		t.Errorf("Expected 16 bytes total, got %d", capture.Total())
+	}
+	if out := capture.String(); out != "0123\n[... 8 bytes truncated ...]\ncdef" {
+		t.Errorf("Unexpected capped output %q", out)
+	}
+
+	full, _ := os.ReadFile(disk.Name())
+	if string(full) != "0123456789abcdef" {
+		t.Errorf("Full output on disk is %q", full)
+	}
+
+	small := newCappedOutput(nil, 4, 4, 0)
+	small.Write([]byte("hello"))
+	if small.Truncated() || small.String() != "hello" {
+		t.Errorf("Short output should be kept whole, got %q", small.String())
+	}
+}
+
+// Huge head and tail values are clamped instead of sizing the buffers
+func TestQueryOutputCaps(t *testing.T) {
+	outputHeadBytes, outputTailBytes = 100, 200
+	for query, want := range map[string][2]int{
+		"":                        {100, 200},
+		"head=5&tail=6":           {5, 6},
+		"head=999999999999&tail=": {maxOutputKeepBytes, 200},
+	} {
+		head, tail, err := queryOutputCaps(httptest.NewRequest("GET", "/shell?"+query, nil))
+		if err != nil || head != want[0] || tail != want[1] {
+			t.Errorf("%s: got %d, %d, %v", query, head, tail, err)
+		}
+	}
+	if _, _, err := queryOutputCaps(httptest.NewRequest("GET", "/shell?tail=-1", nil)); err == nil {
+		t.Error("a negative tail was accepted")
+	}
+}
+
+// The executor must never exceed its global or per-session limits
+func TestExecutorLimits(t *testing.T) {
+	initExecutor(3, 1)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	running, maxRunning := 0, 0
+	perSession := make(map[string]int)
+
+	for i := 0; i < 20; i++ {
+		session := "limits" + string(rune('A'+i%5))
+		wg.Add(1)
+		executor.Submit(&ticketJob{session: session, ticket: i + 1, parallel: true, run: func() {
+			defer wg.Done()
+			mu.Lock()
+			running++
+			perSession[session]++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			if perSession[session] > 1 {
+				t.Errorf("Session %s ran %d tickets at once", session, perSession[session])
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			perSession[session]--
+			mu.Unlock()
+		}})
+	}
+	wg.Wait()
+
+	if maxRunning > 3 {
+		t.Errorf("Expected at most 3 tickets at once, got %d", maxRunning)
+	}
+	if executor.Queued() != 0 {
+		t.Errorf("Expected an empty queue, got %d", executor.Queued())
+	}
+}
+
+// Serial tickets run strictly in ticket order, even when submitted out of order
+func TestExecutorSerialOrder(t *testing.T) {
+	initExecutor(4, 4)
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	wg.Add(5)
+
+	// Hold the first ticket so the rest queue up behind it
+	release := make(chan struct{})
+	executor.Submit(&ticketJob{session: "serial", ticket: 1, run: func() {
+		defer wg.Done()
+		<-release
+		mu.Lock()
+		order = append(order, 1)
+		mu.Unlock()
+	}})
+	for _, ticket := range []int{4, 2, 5, 3} {
+		ticket := ticket
+		executor.Submit(&ticketJob{session: "serial", ticket: ticket, run: func() {
+			defer wg.Done()
+			mu.Lock()
+			order = append(order, ticket)
+			mu.Unlock()
+		}})
+	}
+
+	if status, position := executor.State("serial", 3); status != statusQueued || position != 2 {
+		t.Errorf("Expected ticket 3 to be QUEUED at position 2, got %s %d", status, position)
+	}
+	close(release)
+	wg.Wait()
+
+	for i, ticket := range order {
+		if ticket != i+1 {
+			t.Fatalf("Tickets ran out of order: %v", order)
+		}
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	steps, _, err := parseBatch(`["echo one", "cd /tmp && ls"]`)
+	if err != nil || len(steps) != 2 || steps[1] != "cd /tmp && ls" {
+		t.Errorf("Unexpected JSON batch %v (%v)", steps, err)
+	}
+
+	steps, _, err = parseBatch("echo one\n\n  \necho two\n")
+	if err != nil || len(steps) != 2 || steps[1] != "echo two" {
+		t.Errorf("Unexpected line batch %v (%v)", steps, err)
+	}
+
+	steps, stdins, err := parseBatch(`["echo one", {"cmd": "wc -c", "b64stdin": "aGVsbG8="}]`)
+	if err != nil || len(steps) != 2 || steps[1] != "wc -c" || stdins[0] != nil || string(stdins[1]) != "hello" {
+		t.Errorf("Unexpected batch with stdin %v %q (%v)", steps, stdins, err)
+	}
+
+	for _, bad := range []string{"", "[]", `["ok", ""]`, `[1, 2]`, `[{"cmd": "cat", "b64stdin": "%%"}]`} {
+		if _, _, err := parseBatch(bad); err == nil {
+			t.Errorf("Expected batch %q to be rejected", bad)
+		}
+	}
+}
+
+// Dependent tickets wait, then run or get cancelled depending on the outcome
+func TestExecutorDependencies(t *testing.T) {
+	initExecutor(4, 4)
+	var mu sync.Mutex
+	outcomes := map[int]bool{}
+	executor.outcome = func(session string, ticket int) (bool, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		succeeded, done := outcomes[ticket]
+		return done, succeeded
+	}
+
+	release := make(chan struct{})
+	results := make(chan string, 4)
+	job := func(ticket int, succeed bool, after []int, on string) *ticketJob {
+		return &ticketJob{session: "deps", ticket: ticket, parallel: true, after: after, on: on,
+			run: func() {
+				if ticket == 1 {
+					<-release
+				}
+				mu.Lock()
+				outcomes[ticket] = succeed
+				mu.Unlock()
+				results <- fmt.Sprintf("%d ran", ticket)
+			},
+			cancel: func(reason string) {
+				mu.Lock()
+				outcomes[ticket] = false
+				mu.Unlock()
+				results <- fmt.Sprintf("%d cancelled", ticket)
+			},
+		}
+	}
+
+	executor.Submit(job(1, false, nil, ""))
+	executor.Submit(job(2, true, []int{1}, onSuccess))
+	executor.Submit(job(3, true, []int{1}, onFailure))
+	executor.Submit(job(4, true, []int{2}, onAlways))
+
+	if status, _ := executor.State("deps", 2); status != statusWaiting {
+		t.Errorf("Expected ticket 2 to be WAITING, got %s", status)
+	}
+	if waiting := executor.Waiting("deps", 2); len(waiting) != 1 || waiting[0] != 1 {
+		t.Errorf("Expected ticket 2 to wait for ticket 1, got %v", waiting)
+	}
+	close(release)
+
+	got := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		select {
+		case result := <-results:
+			got[result] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for dependent tickets, got %v", got)
+		}
+	}
+	for _, expected := range []string{"1 ran", "2 cancelled", "3 ran", "4 ran"} {
+		if !got[expected] {
+			t.Errorf("Expected %q, got %v", expected, got)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	base := time.Date(2025, 3, 14, 10, 7, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/10 * * * *", time.Date(2025, 3, 14, 10, 10, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2025, 3, 14, 13, 0, 0, 0, time.UTC)},
+		{"30 2 1 * *", time.Date(2025, 4, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2025, 3, 16, 0, 0, 0, 0, time.UTC)},
+		// Day-of-month and day-of-week match when either does
+		{"0 0 20 * 1", time.Date(2025, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"15 6 29 2 *", time.Date(2028, 2, 29, 6, 15, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		spec, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", c.expr, err)
+		}
+		if got := spec.Next(base); !got.Equal(c.want) {
+			t.Errorf("%q: got %s, want %s", c.expr, got, c.want)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+// Due schedules fire once per tick and record the ticket they got
+func TestSchedulerTick(t *testing.T) {
+	sessionsDir = t.TempDir()
+	workspacesDir = t.TempDir()
+	store = &fileStorage{dir: sessionsDir}
+	initExecutor(1, 1)
+	if err := os.MkdirAll(filepath.Join(sessionsDir, "cron"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s := &Scheduler{sessions: make(map[string][]*Schedule)}
+	for _, sc := range []*Schedule{
+		{Input: "true", Every: "1m", NextRun: now},
+		{Input: "true", Every: "1m", NextRun: now.Add(time.Minute)},
+		{Input: "true", Cron: "0 0 31 2 *", NextRun: now},
+	} {
+		if err := s.Add("cron", sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.tick(now)
+	list := s.List("cron")
+	if list[0].Runs != 1 || list[0].LastTicket != 1 || !list[0].NextRun.Equal(now.Add(time.Minute)) {
+		t.Errorf("the due schedule: %+v", list[0])
+	}
+	if list[1].Runs != 0 {
+		t.Errorf("a schedule that was not due fired: %+v", list[1])
+	}
+	if !list[2].Paused || list[2].Runs != 0 {
+		t.Errorf("a cron that never matches: %+v", list[2])
+	}
+	s.tick(now)
+	if list := s.List("cron"); list[0].Runs != 1 {
+		t.Errorf("a schedule fired twice in one period: %+v", list[0])
+	}
+	saved, err := loadSchedules(filepath.Join(sessionsDir, "cron"))
+	if err != nil || len(saved) != 3 || saved[0].LastTicket != 1 {
+		t.Errorf("saved %+v, %v", saved, err)
+	}
+}
+
+// Running jobs are capped per session and across the server, ended ones do
+// not count
+func TestJobLimits(t *testing.T) {
+	sessionsDir = t.TempDir()
+	workspacesDir = t.TempDir()
+	store = &fileStorage{dir: sessionsDir}
+	jobs = &JobManager{sessions: make(map[string]map[int]*Job)}
+	fill := func(session string, n int, status string) {
+		jobs.sessions[session] = make(map[int]*Job)
+		for id := 1; id <= n; id++ {
+			jobs.sessions[session][id] = &Job{ID: id, Status: status}
+		}
+	}
+	runner, err := sessionRunner("busy", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fill("busy", maxSessionJobs, jobRunning)
+	if _, err := jobs.Start("busy", runner, "true", ""); err == nil || !strings.Contains(err.Error(), "already runs 8 jobs") {
+		t.Errorf("a session started more jobs than allowed: %v", err)
+	}
+	for i := 0; maxSessionJobs*(i+1) < maxJobs; i++ {
+		fill(fmt.Sprintf("other%d", i), maxSessionJobs, jobRunning)
+	}
+	fill("idle", 0, jobRunning)
+	if _, err := jobs.Start("idle", runner, "true", ""); err == nil || !strings.Contains(err.Error(), "server already runs 64 jobs") {
+		t.Errorf("the server started more jobs than allowed: %v", err)
+	}
+
+	jobs.sessions = make(map[string]map[int]*Job)
+	fill("busy", maxSessionJobs, jobExited)
+	job, err := jobs.Start("busy", runner, "true", "")
+	if err != nil {
+		t.Fatalf("ended jobs still count: %v", err)
+	}
+	<-job.done
+}
+
+func TestRotatingLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.log")
+	log, err := newRotatingLog(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(log, "line %d\n", i)
+	}
+	start, prevStart, total := log.Offsets()
+	if total != 35 || start != 30 || prevStart != 20 {
+		t.Fatalf("offsets start=%d prevStart=%d total=%d", start, prevStart, total)
+	}
+
+	// Bytes before the rotated log are skipped
+	data, from, _, err := log.ReadAt(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 20 || string(data) != "\nline 3\nline 4\n" {
+		t.Errorf("got %q from %d", data, from)
+	}
+
+	// Ranges spanning both files are joined
+	data, from, _, err = log.ReadAt(27, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 27 || string(data) != "\nline" {
+		t.Errorf("got %q from %d", data, from)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n15\n16\n"
+	want := `--- a
++++ b
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -11,5 +11,5 @@
+ 11
+ 12
+ 13
+-14
+ 15
++16
+`
+	if got := unifiedDiff("a", "b", a, b); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if got := unifiedDiff("a", "b", a, a); got != "" {
+		t.Errorf("identical texts produced a diff:\n%s", got)
+	}
+	if got := unifiedDiff("a", "b", "", "x\n"); got != "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+x\n" {
+		t.Errorf("got:\n%s", got)
+	}
+}
+
+// Watches and waits are capped per session and across the server
+func TestWatchLimits(t *testing.T) {
+	initWatches()
+	fill := func(session string, n int) {
+		watches.sessions[session] = make(map[int]chan struct{})
+		for ticket := 1; ticket <= n; ticket++ {
+			watches.sessions[session][ticket] = make(chan struct{})
+		}
+	}
+	block := func(stop <-chan struct{}) { <-stop }
+
+	fill("busy", maxSessionWatches)
+	if err := watches.Start("busy", 99, block); err == nil || !strings.Contains(err.Error(), "already runs 8 watches and waits") {
+		t.Errorf("a session started more watches than allowed: %v", err)
+	}
+	for i := 0; maxSessionWatches*(i+1) < maxWatches; i++ {
+		fill(fmt.Sprintf("other%d", i), maxSessionWatches)
+	}
+	if err := watches.Start("idle", 1, block); err == nil || !strings.Contains(err.Error(), "server already runs 64") {
+		t.Errorf("the server started more watches than allowed: %v", err)
+	}
+	if len(watches.sessions["idle"]) != 0 {
+		t.Error("a refused watch was recorded")
+	}
+}
+
+// /wait takes exactly one probe, keeps tcp and http on loopback and bounds
+// its timeout and interval
+func TestWaitParams(t *testing.T) {
+	sessionsDir = t.TempDir()
+	store = &fileStorage{dir: sessionsDir}
+	hashPassword = "0123456789abcdef0123456789abcdef"
+	isolated := filepath.Join(sessionsDir, "isolated")
+	os.MkdirAll(isolated, 0755)
+	if err := saveSessionConfig(isolated, &SessionConfig{Sandbox: sandboxNamespace, Network: "none"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct{ query, want string }{
+		{"session=wait", "Provide exactly one of"},
+		{"session=wait&tcp=8080&process=x", "Provide exactly one of"},
+		{"session=wait&tcp=nonsense", "Invalid 'tcp' parameter, use a port"},
+		{"session=wait&tcp=example.com:80", "only localhost can be probed"},
+		{"session=wait&tcp=10.0.0.1:80", "only localhost can be probed"},
+		{"session=wait&http=ftp://localhost/", "Invalid 'http' parameter, use a URL"},
+		{"session=wait&http=http://example.com/", "only localhost can be probed"},
+		{"session=wait&http=http://127.0.0.1/&status=99", "Invalid 'status' parameter"},
+		{"session=wait&b64cmd=%25%25", "Failed to decode base64 command"},
+		{"session=isolated&tcp=8080", "network of its own"},
+		{"session=isolated&http=http://localhost/", "network of its own"},
+		{"session=wait&process=x&timeout=0s", "Invalid 'timeout' parameter"},
+		{"session=wait&process=x&timeout=2h", "Invalid 'timeout' parameter"},
+		{"session=wait&process=x&timeout=soon", "Invalid 'timeout' parameter"},
+		{"session=wait&process=x&interval=10ms", "Invalid 'interval' parameter"},
+	} {
+		w := httptest.NewRecorder()
+		waitHandler(w, httptest.NewRequest("GET", "/wait?hash="+hashPassword+"&"+test.query, nil))
+		if !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("%s: got %q, want %q", test.query, w.Body.String(), test.want)
+		}
+	}
+	if tickets, _ := store.Tickets("wait"); len(tickets) != 0 {
+		t.Errorf("refused waits created tickets %v", tickets)
+	}
+}
+
+// tcp and http probes against listeners of the test
+func TestWaitProbeCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := &waitProbe{Kind: "tcp", Target: listener.Addr().String()}
+	if ok, detail := probe.Check(context.Background(), "wait"); !ok {
+		t.Errorf("an open port failed the check: %s", detail)
+	}
+	listener.Close()
+	if ok, _ := probe.Check(context.Background(), "wait"); ok {
+		t.Error("a closed port passed the check")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "http://example.com/", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	for _, test := range []struct {
+		path   string
+		status int
+		want   bool
+	}{
+		{"/health", 0, true},
+		{"/health", http.StatusAccepted, true},
+		{"/health", http.StatusOK, false},
+		{"/moved", 0, false},
+		{"/moved", http.StatusFound, true},
+	} {
+		probe := &waitProbe{Kind: "http", Target: server.URL + test.path, Status: test.status}
+		if ok, detail := probe.Check(context.Background(), "wait"); ok != test.want {
+			t.Errorf("%s with status %d: got %v, %s", test.path, test.status, ok, detail)
+		}
+	}
+}
+
+// A wait that never sees its condition times out with 124, and one that is
+// stopped is cancelled
+func TestRunWaitOutcomes(t *testing.T) {
+	sessionsDir = t.TempDir()
+	store = &fileStorage{dir: sessionsDir}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	wait := func(timeout time.Duration, stop chan struct{}) (string, *TicketMeta) {
+		forest, err := newTicket(nil, "wait", "wait for "+closed, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		probe := &waitProbe{Kind: "tcp", Target: closed, Runner: forest}
+		runWait(forest, "wait", probe, minWaitInterval, timeout)(stop)
+		content, _ := store.ReadTicket("wait", forest.Ticket)
+		meta, _ := store.LoadMeta("wait", forest.Ticket)
+		return string(content), meta
+	}
+
+	content, meta := wait(100*time.Millisecond, make(chan struct{}))
+	if !strings.Contains(content, "EXIT_CODE: 124") || !strings.Contains(content, "Timed out") || meta.Status != ticketTimedOut {
+		t.Errorf("timed out wait: %s, %+v", content, meta)
+	}
+
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	content, meta = wait(time.Hour, stop)
+	if !strings.Contains(content, "EXIT_CODE: -1") || !strings.Contains(content, "Stopped after") || meta.Status != ticketCancelled {
+		t.Errorf("stopped wait: %s, %+v", content, meta)
+	}
+}
+
+// Parts may arrive in any order and be resent, and a commit checks that
+// none is missing and that the payload matches its checksum
+func TestUpload(t *testing.T) {
+	sessionsDir = t.TempDir()
+	workspacesDir = t.TempDir()
+	store = &fileStorage{dir: sessionsDir}
+	hashPassword = "0123456789abcdef0123456789abcdef"
+	uploadMaxBytes = 16
+	call := func(action string, query string) string {
+		w := httptest.NewRecorder()
+		uploadHandler(w, httptest.NewRequest("GET", "/upload/"+action+"?hash="+hashPassword+"&session=up&"+query, nil))
+		return w.Body.String()
+	}
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	_, id, _ := strings.Cut(call("begin", ""), "UPLOAD_ID: ")
+	id, _, _ = strings.Cut(id, "\n")
+	part := func(n int, data string) string {
+		return call("part", fmt.Sprintf("id=%s&n=%d&b64=%s", id, n, b64(data)))
+	}
+	commit := func(payload string) string {
+		sum := sha256.Sum256([]byte(payload))
+		return call("commit", fmt.Sprintf("id=%s&as=file&path=out.txt&sha256=%x", id, sum))
+	}
+
+	if got := part(2, "world"); !strings.Contains(got, "part 1 is still missing") {
+		t.Errorf("part 2 alone: %q", got)
+	}
+	if got := commit("world"); !strings.Contains(got, "part 1 is missing") {
+		t.Errorf("commit without part 1: %q", got)
+	}
+	part(1, "hellX")
+	part(4, "?")
+	if got := commit("hellXworld?"); !strings.Contains(got, "missing part 3") {
+		t.Errorf("commit without part 3: %q", got)
+	}
+	part(3, "!")
+
+	// Resending a part replaces it and only its new size counts
+	if got := part(1, "hello"); !strings.Contains(got, "holds 12 bytes in parts 1 to 4") {
+		t.Errorf("resent part 1: %q", got)
+	}
+	if got := part(5, "12345"); !strings.Contains(got, "larger than 16 bytes") {
+		t.Errorf("part over the size cap: %q", got)
+	}
+	if got := part(2, "world1234"); !strings.Contains(got, "holds 16 bytes") {
+		t.Errorf("resent part 2 up to the cap: %q", got)
+	}
+
+	if got := commit("hellXworld1234!?"); !strings.Contains(got, "Checksum mismatch") {
+		t.Errorf("commit with the wrong checksum: %q", got)
+	}
+	if got := commit("helloworld1234!?"); !strings.Contains(got, "Wrote 16 bytes") {
+		t.Fatalf("commit: %q", got)
+	}
+	if data, err := os.ReadFile(filepath.Join(workspacesDir, "up", "out.txt")); string(data) != "helloworld1234!?" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if got := commit("helloworld1234!?"); !strings.Contains(got, "does not exist") {
+		t.Errorf("a committed upload is kept: %q", got)
+	}
+}
+
+// /tree and /search page through their results, skip ignored names and
+// stop at their caps
+func TestTreeAndSearch(t *testing.T) {
+	workspacesDir = t.TempDir()
+	hashPassword = "0123456789abcdef0123456789abcdef"
+	root := filepath.Join(workspacesDir, "explore")
+	for _, dir := range []string{"src/deep/deeper", "node_modules/pkg"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"a.go":                      "package a\nfunc needle() {}\n",
+		"b.txt":                     "needle\nhay\nneedle\n",
+		"src/c.go":                  "needle()\n",
+		"src/deep/deeper/d.go":      "needle\n",
+		"node_modules/pkg/index.js": "needle\n",
+		"long.txt":                  "needle\n" + strings.Repeat("x", searchReadBuffer+1) + "\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call := func(handler http.HandlerFunc, path string, query string) string {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path+"?hash="+hashPassword+"&session=explore&"+query, nil))
+		return w.Body.String()
+	}
+
+	tree := call(treeHandler, "/tree", "")
+	if strings.Contains(tree, "index.js") || !strings.Contains(tree, "deeper/ (1 entry)") {
+		t.Errorf("default tree:\n%s", tree)
+	}
+	if tree := call(treeHandler, "/tree", "ignore=&depth=9"); !strings.Contains(tree, "index.js") || !strings.Contains(tree, "d.go") {
+		t.Errorf("tree without ignore:\n%s", tree)
+	}
+	page := call(treeHandler, "/tree", "limit=2&offset=1")
+	if !strings.Contains(page, "ENTRIES: 1-3 of 7") || !strings.Contains(page, "offset=3") {
+		t.Errorf("tree page:\n%s", page)
+	}
+	workspace, err := os.OpenRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workspace.Close()
+	var lines []string
+	if walkTree(workspace, ".", 0, 9, nil, &lines, 3) || len(lines) != 3 {
+		t.Errorf("a tree capped at 3 entries walked %d", len(lines))
+	}
+
+	search := call(searchHandler, "/search", "pattern=needle")
+	if !strings.Contains(search, "MATCHES: 0-6 of 6") || strings.Contains(search, "index.js") || !strings.Contains(search, "FILES_SKIPPED: 1") {
+		t.Errorf("search:\n%s", search)
+	}
+	if search := call(searchHandler, "/search", "pattern=needle&glob=*.go&limit=1&offset=1"); !strings.Contains(search, "MATCHES: 1-2 of 3") || !strings.Contains(search, "offset=2") {
+		t.Errorf("search page:\n%s", search)
+	}
+	if search := call(searchHandler, "/search", "pattern=needle&ignore="); !strings.Contains(search, "node_modules/pkg/index.js:1: needle") {
+		t.Errorf("search without ignore:\n%s", search)
+	}
+
+	re := regexp.MustCompile("needle")
+	if found := searchWalk(workspace, ".", re, nil, nil, 3); found.walkedAll || len(found.matches) > 3 {
+		t.Errorf("a search capped at 3 entries got %+v", found)
+	}
+	if err := os.WriteFile(filepath.Join(root, "many.txt"), []byte(strings.Repeat("needle\n", maxSearchMatches+1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if found := searchWalk(workspace, ".", re, []string{"many.txt"}, nil, maxSearchEntries); found.complete || len(found.matches) != maxSearchMatches {
+		t.Errorf("a search capped at %d matches got %d", maxSearchMatches, len(found.matches))
+	}
+}
+
+// A directory swapped for a symlink after /tree or /search checked the path
+// must not lead the walk out of the workspace
+func TestExploreSwap(t *testing.T) {
+	workspacesDir = t.TempDir()
+	outside := t.TempDir()
+	root := filepath.Join(workspacesDir, "ws")
+	os.MkdirAll(filepath.Join(root, "src"), 0755)
+	os.WriteFile(filepath.Join(root, "src", "a.txt"), []byte("needle\n"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("needle\n"), 0644)
+
+	full, err := workspaceFile("ws", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(root, "src"))
+	os.Symlink(outside, filepath.Join(root, "src"))
+	os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "link.txt"))
+
+	workspace, rel, err := workspaceRoot("ws", full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workspace.Close()
+	var lines []string
+	walkTree(workspace, rel, 0, 9, nil, &lines, 100)
+	if found := searchWalk(workspace, rel, regexp.MustCompile("needle"), nil, nil, 100); len(found.matches) != 0 {
+		t.Errorf("searched through a swapped directory: %v", found.matches)
+	}
+	if found := searchWalk(workspace, ".", regexp.MustCompile("needle"), nil, nil, 100); len(found.matches) != 0 {
+		t.Errorf("searched through symlinks: %v", found.matches)
+	}
+	for _, line := range lines {
+		if strings.Contains(line, "secret") {
+			t.Errorf("listed a swapped directory: %v", lines)
+		}
+	}
+}
+
+// Artifacts stay inside the workspace unless elevated, never come from a
+// hidden path and are capped in count and size
+func TestCaptureArtifacts(t *testing.T) {
+	sessionsDir = t.TempDir()
+	workspacesDir = t.TempDir()
+	artifactBytes = 1024
+	outside := t.TempDir()
+	root := filepath.Join(workspacesDir, "art")
+	for _, dir := range []string{filepath.Join(root, "out"), filepath.Join(root, "many"), filepath.Join(sessionsDir, "other")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(path string, size int) {
+		if err := os.WriteFile(path, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(root, "out", "a.txt"), 10)
+	write(filepath.Join(root, "out", "b.log"), 10)
+	write(filepath.Join(root, "big.bin"), 2000)
+	write(filepath.Join(outside, "secret.txt"), 10)
+	write(filepath.Join(outside, "other.txt"), 10)
+	write(filepath.Join(outside, "third.txt"), 10)
+	write(filepath.Join(sessionsDir, "other", "01.ticket"), 10)
+	for i := 0; i <= maxArtifactFiles; i++ {
+		write(filepath.Join(root, "many", fmt.Sprintf("%03d", i)), 1)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "out", "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	capture := func(elevated bool, globs ...string) map[string]string {
+		runner := &Runnner{SessionFolder: filepath.Join(sessionsDir, "art"), Ticket: 1, Elevated: elevated, Artifacts: globs}
+		got := make(map[string]string)
+		for _, artifact := range captureArtifacts("art", runner) {
+			got[artifact.Path] = artifact.Error
+		}
+		return got
+	}
+
+	// Through a symlinked file, a symlinked directory and .. in the glob
+	got := capture(false, "out/*.t?t", "escape/other.txt", filepath.Join("..", "..", filepath.Base(outside), "*.txt"), "big.bin")
+	if err, ok := got[filepath.Join(root, "out", "a.txt")]; !ok || err != "" {
+		t.Errorf("a.txt: %q, %v", err, ok)
+	}
+	if _, ok := got[filepath.Join(root, "out", "b.log")]; ok {
+		t.Error("the glob matched b.log")
+	}
+	outsideErrors := 0
+	for path, err := range got {
+		if strings.Contains(err, "outside the workspace") {
+			outsideErrors++
+		} else if strings.HasSuffix(path, "secret.txt") || strings.HasSuffix(path, "other.txt") || strings.HasSuffix(path, "link.txt") {
+			t.Errorf("%s: %q", path, err)
+		}
+	}
+	if outsideErrors != 5 {
+		t.Errorf("got %d files outside the workspace, want link.txt, secret.txt, both other.txt and third.txt: %v", outsideErrors, got)
+	}
+	if big := got[filepath.Join(root, "big.bin")]; !strings.Contains(big, "exceed 1024 bytes") {
+		t.Errorf("big.bin: %q", big)
+	}
+	if data, err := os.ReadFile(filepath.Join(ticketArtifactsPath(filepath.Join(sessionsDir, "art"), 1), "out", "a.txt")); err != nil || len(data) != 10 {
+		t.Errorf("a.txt was kept as %q, %v", data, err)
+	}
+
+	secret, ticket := filepath.Join(outside, "secret.txt"), filepath.Join(sessionsDir, "other", "01.ticket")
+	got = capture(true, secret, ticket)
+	if got[secret] != "" {
+		t.Errorf("an elevated ticket could not keep secret.txt: %q", got[secret])
+	}
+	if !strings.Contains(got[ticket], "hidden") {
+		t.Errorf("an elevated ticket kept a ticket of another session: %q", got[ticket])
+	}
+
+	// The checks go by the file that was opened, not the path it was found at
+	if err := os.Symlink(ticket, filepath.Join(root, "out", "ticket.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if got = capture(true, "out/ticket.txt"); !strings.Contains(got[filepath.Join(root, "out", "ticket.txt")], "hidden") {
+		t.Errorf("an elevated ticket kept a hidden file through a symlink: %v", got)
+	}
+
+	got = capture(false, "many")
+	skipped := 0
+	for _, err := range got {
+		if strings.Contains(err, fmt.Sprintf("at most %d artifacts", maxArtifactFiles)) {
+			skipped++
+		}
+	}
+	if len(got) != maxArtifactFiles+1 || skipped != 1 {
+		t.Errorf("got %d artifacts of which %d were skipped", len(got), skipped)
+	}
+}
+
+func TestWorkspaceFile(t *testing.T) {
+	workspacesDir = t.TempDir()
+	root := filepath.Join(workspacesDir, "ws")
+	os.MkdirAll(filepath.Join(root, "src"), 0755)
+	os.Symlink("/etc", filepath.Join(root, "etc"))
+	os.Symlink("src", filepath.Join(root, "code"))
+	real, _ := filepath.EvalSymlinks(root)
+
+	for path, want := range map[string]string{
+		"src/main.go":                 filepath.Join(real, "src/main.go"),
+		"code/new/file":               filepath.Join(real, "src/new/file"),
+		filepath.Join(root, "a.txt"):  filepath.Join(real, "a.txt"),
+		"src/../b.txt":                filepath.Join(real, "b.txt"),
+		"../other/x":                  "",
+		"etc/passwd":                  "",
+		"/etc/passwd":                 "",
+		filepath.Join(root, "../x/y"): "",
+	} {
+		got, err := workspaceFile("ws", path)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s resolved to %s outside the workspace", path, got)
+			}
+		} else if err != nil || got != want {
+			t.Errorf("%s: got %s, %v, want %s", path, got, err, want)
+		}
+	}
+}
+
+// The workspace is created once for valid names and never through a symlink
+func TestEnsureWorkspace(t *testing.T) {
+	workspacesDir = t.TempDir()
+	id := &Identity{User: "ws", UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}
+	for i := 0; i < 2; i++ {
+		if workspace, err := ensureWorkspace("ws", id); err != nil || workspace != filepath.Join(workspacesDir, "ws") {
+			t.Fatalf("got %s, %v", workspace, err)
+		}
+	}
+	if _, err := ensureWorkspace("../escape", id); err == nil {
+		t.Error("a workspace was made for a session name with a separator")
+	}
+	os.Symlink(t.TempDir(), filepath.Join(workspacesDir, "link"))
+	if _, err := ensureWorkspace("link", id); err == nil {
+		t.Error("a symlink was taken for a workspace")
+	}
+}
+
+// Reading by lines stops at limit even inside a line without line breaks
+func TestReadFileLines(t *testing.T) {
+	workspacesDir = t.TempDir()
+	root := filepath.Join(workspacesDir, "ws")
+	os.MkdirAll(root, 0755)
+	long := strings.Repeat("x", 200*1024)
+	os.WriteFile(filepath.Join(root, "f.txt"), []byte("one\ntwo\n"+long+"\nfour\n"), 0644)
+
+	read := func(query string) string {
+		w := httptest.NewRecorder()
+		readFile(w, httptest.NewRequest("GET", "/file/read?path=f.txt&"+query, nil), "ws")
+		return w.Body.String()
+	}
+	if res := read("lines=1-&limit=10"); !strings.Contains(res, "LINES: 1-2") || !strings.Contains(res, "&lines=3-&limit=10") {
+		t.Errorf("the long line was not left for the next page:\n%s", res)
+	}
+	res := read("lines=3&limit=100")
+	if !strings.Contains(res, "LINES: 3-3") || !strings.Contains(res, "RANGE: 8-108") || !strings.Contains(res, "was cut") || strings.Contains(res, "NEXT") {
+		t.Errorf("the long line was not cut at the limit:\n%s", res)
+	}
+	if res := read("lines=4&limit=100"); !strings.Contains(res, "     4\tfour") {
+		t.Errorf("the line after the long one was lost:\n%s", res)
+	}
+}
+
+// A directory swapped for a symlink after the path was checked must not lead
+// the server's own reads and writes out of the workspace
+func TestWorkspaceFileSwap(t *testing.T) {
+	workspacesDir = t.TempDir()
+	outside := t.TempDir()
+	root := filepath.Join(workspacesDir, "ws")
+	os.MkdirAll(filepath.Join(root, "dir"), 0755)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+
+	full, err := workspaceFile("ws", "dir/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(root, "dir"))
+	os.Symlink(outside, filepath.Join(root, "dir"))
+	if data, err := readWorkspaceFile("ws", full, 64); err == nil {
+		t.Errorf("read %q through a swapped directory", data)
+	}
+	if err := writeWorkspaceFile("ws", full, []byte("x"), 0644, nil); err == nil {
+		t.Error("wrote through a swapped directory")
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "secret" {
+		t.Errorf("the file outside was changed to %q", data)
+	}
+
+	// Opening a FIFO would block the handler for good
+	fifo := filepath.Join(root, "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Skip(err)
+	}
+	full, _ = workspaceFile("ws", "fifo")
+	if _, _, err := openWorkspaceFile("ws", full); err == nil {
+		t.Error("a FIFO was opened as a regular file")
+	}
+}
+
+// Edits refuse oversized files before reading them and never delete lines
+// unless asked to
+func TestEditLimits(t *testing.T) {
+	sessionsDir = t.TempDir()
+	workspacesDir = t.TempDir()
+	store = &fileStorage{dir: sessionsDir}
+	hashPassword = "0123456789abcdef0123456789abcdef"
+	maxStdinBytes = 1024
+	os.MkdirAll(filepath.Join(workspacesDir, "ed"), 0755)
+	os.WriteFile(filepath.Join(workspacesDir, "ed", "big.txt"), []byte("0123456789\n"), 0644)
+	os.WriteFile(filepath.Join(workspacesDir, "ed", "small.txt"), []byte("a\nb\n"), 0644)
+
+	full, _ := workspaceFile("ed", "big.txt")
+	if _, err := readWorkspaceFile("ed", full, 8); err == nil || !strings.Contains(err.Error(), "larger than 8 bytes") {
+		t.Errorf("read a file over the cap: %v", err)
+	}
+	if data, err := readWorkspaceFile("ed", full, 11); err != nil || string(data) != "0123456789\n" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	w := httptest.NewRecorder()
+	fileHandler(w, httptest.NewRequest("GET", "/file/edit?hash="+hashPassword+"&session=ed&path=small.txt&lines=1-2", nil))
+	if got := w.Body.String(); !strings.Contains(got, "Missing 'b64replace'") {
+		t.Errorf("lines without b64replace: %q", got)
+	}
+	if data, _ := os.ReadFile(filepath.Join(workspacesDir, "ed", "small.txt")); string(data) != "a\nb\n" {
+		t.Errorf("the file was changed to %q", data)
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	text := "a\nb\nc\nd\ne\nf\n"
+	// Written against a version of the file that lacked its first two lines
+	hunks, err := parsePatch("--- a/x\n+++ b/x\n@@ -1,3 +1,3 @@\n c\n-d\n+D\n e\n@@ -4,0 +5,1 @@\n+g\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := applyPatch(text, hunks)
+	if err != nil || got != "a\nb\nc\nD\ne\nf\ng\n" {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	hunks, _ = parsePatch("@@ -2,2 +2,1 @@\n x\n-y\n")
+	if _, err := applyPatch(text, hunks); err == nil {
+		t.Error("a hunk that matches nowhere applied")
+	}
+	if _, err := parsePatch("@@ -1,3 +1,3 @@\n a\n-b\n"); err == nil {
+		t.Error("a truncated hunk parsed")
+	}
+
+	got, err = replaceLines(text, 2, 3, "B\nC\nX\n")
+	if err != nil || got != "a\nB\nC\nX\nd\ne\nf\n" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	snapshotMaxFile = 1 << 20
+	workspacesDir = t.TempDir()
+	sessionFolder := t.TempDir()
+	root := filepath.Join(workspacesDir, "ws")
+	os.MkdirAll(filepath.Join(root, "src"), 0755)
+	os.WriteFile(filepath.Join(root, "src/main.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(root, "run.sh"), []byte("#!/bin/sh\n"), 0755)
+
+	before, err := scanWorkspace("ws", sessionFolder, nil, true)
+	if err != nil || before.Files != 2 {
+		t.Fatalf("got %+v, %v", before, err)
+	}
+
+	os.WriteFile(filepath.Join(root, "src/main.go"), []byte("package broken\n"), 0644)
+	os.Remove(filepath.Join(root, "run.sh"))
+	os.RemoveAll(filepath.Join(root, "src"))
+	os.Symlink("/etc", filepath.Join(root, "src"))
+	after, err := scanWorkspace("ws", sessionFolder, before, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatChanges(diffSnapshots(before, after)); got != "D run.sh (10B)\nM src (dir -> symlink)\nD src/main.go (13B)\n" {
+		t.Errorf("got changes %q", got)
+	}
+
+	if err := applySnapshot("ws", sessionFolder, after, before, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "src/main.go")); string(data) != "package main\n" {
+		t.Errorf("src/main.go holds %q", data)
+	}
+	if info, err := os.Lstat(filepath.Join(root, "run.sh")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("run.sh not restored with its mode: %v", err)
+	}
+	restored, _ := scanWorkspace("ws", sessionFolder, nil, false)
+	if changes := diffSnapshots(before, restored); len(changes) != 0 {
+		t.Errorf("restore left %s", formatChanges(changes))
+	}
+}
+
+// Restoring a retargeted symlink replaces the link, not the file it points to
+// Files listed as regular but swapped for a symlink, or found through a
+// directory swapped for one, are never read from outside the workspace
+func TestSnapshotSwap(t *testing.T) {
+	snapshotMaxFile = 1 << 20
+	workspacesDir = t.TempDir()
+	sessionFolder := t.TempDir()
+	outside := t.TempDir()
+	root := filepath.Join(workspacesDir, "ws")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret\n"), 0644)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "link"))
+	os.Symlink(outside, filepath.Join(root, "dir"))
+
+	workspace, err := os.OpenRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workspace.Close()
+	for _, path := range []string{"link", "dir/secret"} {
+		if sum, err := storeObject(sessionFolder, workspace, path); err == nil {
+			t.Errorf("stored %s as %s", path, sum)
+		}
+		if sum, err := hashFile(workspace, path); err == nil {
+			t.Errorf("hashed %s as %s", path, sum)
+		}
+		if text, ok := snapshotText("ws", sessionFolder, &SnapshotEntry{Type: "file"}, path, true); ok || text != "" {
+			t.Errorf("read %s as %q", path, text)
+		}
+	}
+}
+
+func TestSnapshotRestoreSymlink(t *testing.T) {
+	workspacesDir = t.TempDir()
+	sessionFolder := t.TempDir()
+	outside := t.TempDir()
+	root := filepath.Join(workspacesDir, "ws")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(outside, "b.txt"), []byte("b"), 0644)
+	os.Symlink("a.txt", filepath.Join(root, "link"))
+
+	before, err := scanWorkspace("ws", sessionFolder, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(root, "link"))
+	os.Symlink(filepath.Join(outside, "b.txt"), filepath.Join(root, "link"))
+	after, _ := scanWorkspace("ws", sessionFolder, before, true)
+
+	if err := applySnapshot("ws", sessionFolder, after, before, nil); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "link")); err != nil || target != "a.txt" {
+		t.Errorf("link points to %q, %v", target, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(outside, "b.txt")); err != nil || string(data) != "b" {
+		t.Errorf("the old target was touched: %q, %v", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "a.txt")); err == nil {
+		t.Error("a link was created at the old target's location")
+	}
+}
+
+func TestAllocateTicketConcurrency(t *testing.T) {
+	files := &fileStorage{dir: t.TempDir()}
+	sessionFolder := files.folder("s")
+	const goroutines = 50
+	const perGoroutine = 20
+
+	// Another server sharing the sessions directory, without our mutex
+	otherServer := func(string) (int, error) {
+		ticket, err := getNextTicket(sessionFolder)
+		if err != nil {
+			return 0, err
+		}
+		for {
+			file, err := os.OpenFile(filepath.Join(sessionFolder, fmt.Sprintf("%02d.ticket", ticket)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err == nil {
+				return ticket, file.Close()
+			}
+			if !os.IsExist(err) {
+				return 0, err
+			}
+			ticket++
+		}
+	}
+
+	var mu sync.Mutex
+	seen := make(map[int]int)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perGoroutine; j++ {
+				allocate := files.AllocateTicket
+				if i%5 == 0 {
+					allocate = otherServer
+				}
+				ticket, err := allocate("s")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				seen[ticket]++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(seen) != goroutines*perGoroutine {
+		t.Errorf("got %d distinct tickets, want %d", len(seen), goroutines*perGoroutine)
+	}
+	for ticket := 1; ticket <= goroutines*perGoroutine; ticket++ {
+		if seen[ticket] != 1 {
+			t.Errorf("ticket %d was handed out %d times", ticket, seen[ticket])
+		}
+	}
+
+	// Concurrent submissions to one session through newTicket
+	sessionsDir = t.TempDir()
+	store = &fileStorage{dir: sessionsDir}
+	tickets := make(chan int, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forest, err := newTicket(nil, "hammer", "true", "", false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tickets <- forest.Ticket
+		}()
+	}
+	wg.Wait()
+	close(tickets)
+	submitted := make(map[int]bool)
+	for ticket := range tickets {
+		if submitted[ticket] {
+			t.Errorf("ticket %d was handed to two submissions", ticket)
+		}
+		submitted[ticket] = true
+	}
+	if len(submitted) != goroutines {
+		t.Errorf("got %d distinct tickets, want %d", len(submitted), goroutines)
+	}
+}
+
+// Ticket allocation must stay unique when servers share one SQLite database
+func TestSQLiteAllocateTicketConcurrency(t *testing.T) {
+	const goroutines = 50
+	const perGoroutine = 20
+	path := filepath.Join(t.TempDir(), "llmass.db")
+	var servers [2]*sqliteStorage
+	for i := range servers {
+		db, err := openSQLiteStorage(path, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		servers[i] = db
+	}
+
+	// Half the goroutines share session a, the rest each create their own
+	var mu sync.Mutex
+	seen := make(map[string]map[int]int)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session := "a"
+			if i%2 == 1 {
+				session = fmt.Sprintf("s%d", i)
+			}
+			for j := 0; j < perGoroutine; j++ {
+				ticket, err := servers[(i+j)%2].AllocateTicket(session)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[session] == nil {
+					seen[session] = make(map[int]int)
+				}
+				seen[session][ticket]++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for session, tickets := range seen {
+		want := perGoroutine
+		if session == "a" {
+			want = perGoroutine * goroutines / 2
+		}
+		for ticket := 1; ticket <= want; ticket++ {
+			if tickets[ticket] != 1 {
+				t.Errorf("ticket %d of session %s was handed out %d times", ticket, session, tickets[ticket])
+			}
+		}
+		if len(tickets) != want {
+			t.Errorf("session %s got %d distinct tickets, want %d", session, len(tickets), want)
+		}
+	}
+
+	// Concurrent submissions through newTicket
+	sessionsDir = servers[0].dir
+	store = servers[0]
+	defer func() { store = &fileStorage{dir: sessionsDir} }()
+	submitted := make(map[int]bool)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forest, err := newTicket(nil, "hammer", "true", "", false)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			if submitted[forest.Ticket] {
+				t.Errorf("ticket %d was handed to two submissions", forest.Ticket)
+			}
+			submitted[forest.Ticket] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(submitted) != goroutines {
+		t.Errorf("got %d distinct tickets, want %d", len(submitted), goroutines)
+	}
+}
+
+// A ticket's scan window is shared when other work in the session began
+// before it, began during it or is still running
+func TestActivityOverlap(t *testing.T) {
+	tracker := &ActivityTracker{running: make(map[string]int), started: make(map[string]uint64)}
+	alone := tracker.Begin("s")
+	if tracker.Overlapped(alone) {
+		t.Error("work alone in its session overlapped")
+	}
+	tracker.End(alone)
+
+	ticket := tracker.Begin("s")
+	tracker.End(tracker.Begin("s"))
+	other := tracker.Begin("t")
+	if !tracker.Overlapped(ticket) {
+		t.Error("work that ran in between was missed")
+	}
+	if tracker.Overlapped(other) {
+		t.Error("work in another session overlapped")
+	}
+	late := tracker.Begin("s")
+	tracker.End(ticket)
+	if !tracker.Overlapped(late) {
+		t.Error("work that was running before was missed")
+	}
+	tracker.End(late)
+	tracker.End(other)
+	if len(tracker.running) != 0 || len(tracker.started) != 0 {
+		t.Errorf("idle sessions are still tracked: %v, %v", tracker.running, tracker.started)
+	}
+}
+
+func TestTicketMeta(t *testing.T) {
+	sessionsDir = t.TempDir()
+	store = &fileStorage{dir: sessionsDir}
+	forest, err := newTicket(nil, "meta", "false", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.LoadMeta("meta", forest.Ticket)
+	if err != nil || meta.Status != ticketQueued || meta.Started != nil {
+		t.Fatalf("got %+v, %v", meta, err)
+	}
+	if done, ok := ticketOutcome("meta", forest.Ticket); done || ok {
+		t.Errorf("a queued ticket reported done %v, succeeded %v", done, ok)
+	}
+
+	startTicketMeta(forest, "synchronous", "meta")
+	finishTicketMeta(&CmdResults{Type: "synchronous", Session: "meta", Ticket: forest.Ticket, ExitCode: 1, OutputBytes: 3}, ticketFailed)
+	meta, _ = store.LoadMeta("meta", forest.Ticket)
+	if meta.Status != ticketFailed || meta.ExitCode == nil || *meta.ExitCode != 1 || meta.Started == nil || meta.Ended == nil || meta.Interpreter != shellInterpreter {
+		t.Errorf("got %+v", meta)
+	}
+	if done, ok := ticketOutcome("meta", forest.Ticket); !done || ok {
+		t.Errorf("a failed ticket reported done %v, succeeded %v", done, ok)
+	}
+
+	forest, _ = newTicket(nil, "meta", "true", "", false)
+	startTicketMeta(forest, "synchronous", "meta")
+	if done, ok := ticketOutcome("meta", forest.Ticket); done || ok {
+		t.Errorf("a running ticket reported done %v, succeeded %v", done, ok)
+	}
+	finishTicketMeta(&CmdResults{Type: "synchronous", Session: "meta", Ticket: forest.Ticket}, ticketSucceeded)
+	if done, ok := ticketOutcome("meta", forest.Ticket); !done || !ok {
+		t.Errorf("a succeeded ticket reported done %v, succeeded %v", done, ok)
+	}
+}
+
+// Reruns take the input from the sidecar, whatever the ticket text holds
+func TestTicketInput(t *testing.T) {
+	sessionsDir = t.TempDir()
+	store = &fileStorage{dir: sessionsDir}
+	input := "echo 'INPUT:\n\nEXIT_CODE: 0\n\n'"
+	forest, err := newTicket(nil, "input", input, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := ticketInput("input", forest.Ticket); err == nil {
+		t.Error("a queued ticket can be rerun")
+	}
+	writeTicket("input", forest.Ticket, "INPUT:\n\nsomething else\n\nEXIT_CODE: 0\n\n")
+	finishTicketMeta(&CmdResults{Type: "synchronous", Session: "input", Ticket: forest.Ticket}, ticketSucceeded)
+	if got, _, steps, _, err := ticketInput("input", forest.Ticket); err != nil || got != input || steps != nil {
+		t.Errorf("got %q, %v, %v", got, steps, err)
+	}
+
+	batch := `[{"cmd": "cat", "b64stdin": "aGk="}, "true"]`
+	b64 := base64.StdEncoding.EncodeToString([]byte(batch))
+	forest, _ = newTicket(nil, "input", "cat\ntrue", b64, false)
+	forest.Steps = []string{"cat", "true"}
+	forest.StepStdin = [][]byte{[]byte("hi"), nil}
+	initExecutor(1, 1)
+	workspacesDir = t.TempDir()
+	if result := <-submitTicket(nil, nil, forest, "synchronous", "input"); result.err != nil || result.cer.ExitCode != 0 {
+		t.Fatalf("the batch failed: %+v, %v", result.cer, result.err)
+	}
+	got, gotB64, steps, stdins, err := ticketInput("input", forest.Ticket)
+	if err != nil || got != "cat\ntrue" || gotB64 != b64 || len(steps) != 2 || len(stdins) != 2 || string(stdins[0]) != "hi" {
+		t.Errorf("got %q, %q, %q, %q, %v", got, gotB64, steps, stdins, err)
+	}
+
+	if _, _, _, _, err := ticketInput("input", 99); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("got %v for a missing ticket", err)
+	}
+}
+
+func TestStorageBackends(t *testing.T) {
+	db, err := openSQLiteStorage("", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, backend := range []Storage{&fileStorage{dir: t.TempDir()}, db} {
+		if exists, err := backend.SessionExists("s"); exists || err != nil {
+			t.Fatalf("%T: new session exists %v, %v", backend, exists, err)
+		}
+		for _, session := range []string{"../escape", ".."} {
+			if backend.CreateSession(session) == nil || backend.DeleteSession(session) == nil {
+				t.Errorf("%T: accepted the session name %q", backend, session)
+			}
+			if _, err := backend.AllocateTicket(session); err == nil {
+				t.Errorf("%T: allocated a ticket for the session name %q", backend, session)
+			}
+		}
+		for want := 1; want <= 2; want++ {
+			if ticket, err := backend.AllocateTicket("s"); ticket != want || err != nil {
+				t.Fatalf("%T: got ticket %d, %v, want %d", backend, ticket, err, want)
+			}
+		}
+		if sessions, _ := backend.Sessions(); len(sessions) != 1 || sessions[0] != "s" {
+			t.Errorf("%T: got sessions %v", backend, sessions)
+		}
+		if _, err := backend.ReadTicket("s", 3); !os.IsNotExist(err) {
+			t.Errorf("%T: reading a missing ticket got %v", backend, err)
+		}
+		if _, err := backend.LoadMeta("s", 1); !os.IsNotExist(err) {
+			t.Errorf("%T: loading missing metadata got %v", backend, err)
+		}
+		backend.WriteTicket("s", 2, []byte("EXIT_CODE: 0\n"))
+		backend.SaveMeta("s", &TicketMeta{Ticket: 2, Status: ticketSucceeded})
+		content, _ := backend.ReadTicket("s", 2)
+		meta, err := backend.LoadMeta("s", 2)
+		if string(content) != "EXIT_CODE: 0\n" || err != nil || meta.Status != ticketSucceeded {
+			t.Errorf("%T: got %q, %+v, %v", backend, content, meta, err)
+		}
+
+		// Output spanning several SQLite rows, read across their boundaries
+		output := []byte(strings.Repeat("0123456789", sqliteChunkBytes/4))
+		out, err := backend.CreateOutput("s", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(output); i += 1000 {
+			out.Write(output[i:min(i+1000, len(output))])
+		}
+		out.Close()
+		data, size, err := backend.ReadOutput("s", 2, sqliteChunkBytes-5, 20)
+		if size != int64(len(output)) || string(data) != string(output[sqliteChunkBytes-5:sqliteChunkBytes+15]) || err != nil {
+			t.Errorf("%T: got %d bytes of %d, %v", backend, len(data), size, err)
+		}
+		if data, _, _ := backend.ReadOutput("s", 2, int64(len(output))-3, 10); string(data) != "789" {
+			t.Errorf("%T: reading past the end got %q", backend, data)
+		}
+		if data, _, err := backend.ReadOutput("s", 2, 1, math.MaxInt); len(data) != len(output)-1 || err != nil {
+			t.Errorf("%T: reading with a huge limit got %d bytes, %v", backend, len(data), err)
+		}
+		if _, _, err := backend.ReadOutput("s", 1, 0, 10); !os.IsNotExist(err) {
+			t.Errorf("%T: reading a missing output got %v", backend, err)
+		}
+
+		if err := backend.DeleteSession("s"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := backend.ReadTicket("s", 2); !os.IsNotExist(err) {
+			t.Errorf("%T: ticket survived its session: %v", backend, err)
+		}
+		if ticket, _ := backend.AllocateTicket("s"); ticket != 1 {
+			t.Errorf("%T: a recreated session started at ticket %d", backend, ticket)
+		}
+	}
+}
+
+// The database lands at STORAGE_PATH even when it is relative or holds URI
+// characters, and flat-file sessions it does not see are found
+func TestSQLitePath(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	flat := &fileStorage{dir: filepath.Join(dir, "sessions")}
+	flat.AllocateTicket("old")
+	db, err := openSQLiteStorage("a?b#c/llmass.db", flat.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.CreateSession("new")
+	if _, err := os.Stat(filepath.Join(dir, "a?b#c", "llmass.db")); err != nil {
+		t.Errorf("the database is not where it was asked for: %v", err)
+	}
+	if unseen, err := db.flatSessions(); len(unseen) != 1 || unseen[0] != "old" || err != nil {
+		t.Errorf("got %v, %v", unseen, err)
+	}
+}
+
 // Run these tests with: go test -race
@@ -0,0 +1,409 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock syscalls share their numbers across architectures
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+)
+
+// Landlock filesystem access rights, the later ones depend on the kernel's ABI
+const (
+	landlockAccessExecute    = 1 << 0
+	landlockAccessWriteFile  = 1 << 1
+	landlockAccessReadFile   = 1 << 2
+	landlockAccessReadDir    = 1 << 3
+	landlockAccessRemoveDir  = 1 << 4
+	landlockAccessRemoveFile = 1 << 5
+	landlockAccessMakeChar   = 1 << 6
+	landlockAccessMakeDir    = 1 << 7
+	landlockAccessMakeReg    = 1 << 8
+	landlockAccessMakeSock   = 1 << 9
+	landlockAccessMakeFifo   = 1 << 10
+	landlockAccessMakeBlock  = 1 << 11
+	landlockAccessMakeSym    = 1 << 12
+	landlockAccessRefer      = 1 << 13 // ABI 2
+	landlockAccessTruncate   = 1 << 14 // ABI 3
+	landlockAccessIoctlDev   = 1 << 15 // ABI 5
+
+	landlockAccessRead = landlockAccessExecute | landlockAccessReadFile | landlockAccessReadDir
+	// Rights that are valid on a rule for a regular file rather than a directory
+	landlockAccessFile = landlockAccessExecute | landlockAccessWriteFile | landlockAccessReadFile |
+		landlockAccessTruncate | landlockAccessIoctlDev
+)
+
+// applySandbox rewrites cmd to re-exec the server as the sandbox init helper,
+// inside fresh mount, PID, UTS, IPC and optionally network namespaces when
+// spec.Namespaces is set
+func applySandbox(cmd *exec.Cmd, spec *sandboxSpec) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate server binary: %v", err)
+	}
+
+	spec.Argv = cmd.Args
+	spec.Env = cmd.Env
+	if spec.Env == nil {
+		spec.Env = os.Environ()
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("failed to encode sandbox spec: %v", err)
+	}
+
+	flags := 0
+	if spec.Namespaces {
+		flags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+		if !spec.Network {
+			flags |= syscall.CLONE_NEWNET
+		}
+	}
+
+	cmd.Path = self
+	cmd.Args = []string{self, sandboxInitArg}
+	cmd.Env = []string{sandboxSpecEnv + "=" + string(data)}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// The helper needs root to mount, it drops to the session user itself
+	cmd.SysProcAttr.Credential = nil
+	cmd.SysProcAttr.Cloneflags = uintptr(flags)
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	return nil
+}
+
+// sandboxInit runs in the child before the real command. With namespaces it
+// is PID 1 and assembles a read-only view of the host root with a writable
+// workspace and private /tmp. It then prepares the Landlock ruleset, drops
+// privileges, restricts itself and execs the real command.
+func sandboxInit() {
+	spec := &sandboxSpec{}
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxSpecEnv)), spec); err != nil {
+		sandboxFatal("invalid sandbox spec: %v", err)
+	}
+	if len(spec.Argv) == 0 {
+		sandboxFatal("sandbox spec has no command")
+	}
+
+	if spec.Namespaces {
+		if err := setupSandboxRoot(spec); err != nil {
+			sandboxFatal("%v", err)
+		}
+		if spec.Hostname != "" {
+			if err := syscall.Sethostname([]byte(spec.Hostname)); err != nil {
+				sandboxFatal("failed to set hostname: %v", err)
+			}
+		}
+		if !spec.Network {
+			if err := bringUpLoopback(); err != nil {
+				sandboxFatal("failed to bring up loopback: %v", err)
+			}
+		}
+	}
+
+	if err := os.Chdir(spec.Workspace); err != nil {
+		sandboxFatal("failed to enter workspace: %v", err)
+	}
+
+	// The ruleset is built while still privileged so every path can be opened
+	rulesetFd := -1
+	if spec.Landlock != nil {
+		fd, err := buildLandlockRuleset(spec.Landlock)
+		if err != nil {
+			sandboxFatal("landlock: %v", err)
+		}
+		rulesetFd = fd
+	}
+
+	if spec.Identity != nil {
+		groups := make([]int, 0, len(spec.Identity.Groups))
+		for _, g := range spec.Identity.Groups {
+			groups = append(groups, int(g))
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			sandboxFatal("failed to set groups: %v", err)
+		}
+		if err := syscall.Setgid(int(spec.Identity.GID)); err != nil {
+			sandboxFatal("failed to set gid: %v", err)
+		}
+		if err := syscall.Setuid(int(spec.Identity.UID)); err != nil {
+			sandboxFatal("failed to set uid: %v", err)
+		}
+	}
+
+	if rulesetFd >= 0 {
+		if err := restrictLandlock(rulesetFd); err != nil {
+			sandboxFatal("landlock: %v", err)
+		}
+	}
+
+	path, err := exec.LookPath(spec.Argv[0])
+	if err != nil {
+		sandboxFatal("%v", err)
+	}
+	if err := syscall.Exec(path, spec.Argv, spec.Env); err != nil {
+		sandboxFatal("failed to exec %s: %v", path, err)
+	}
+}
+
+func sandboxFatal(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "sandbox: "+format+"\n", args...)
+	os.Exit(126)
+}
+
+// Build the new root under a private tmpfs and pivot into it
+func setupSandboxRoot(spec *sandboxSpec) error {
+	// Keep every mount below private to this namespace
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+
+	base := "/run"
+	if _, err := os.Stat(base); err != nil {
+		base = os.TempDir()
+	}
+	if err := syscall.Mount("tmpfs", base, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("failed to mount staging tmpfs: %v", err)
+	}
+	root := filepath.Join(base, "llmass-root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		return fmt.Errorf("failed to create sandbox root: %v", err)
+	}
+
+	if err := syscall.Mount("/", root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind host root: %v", err)
+	}
+	if err := remountReadOnly(root); err != nil {
+		return err
+	}
+
+	if err := syscall.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /tmp: %v", err)
+	}
+	if err := syscall.Mount("proc", filepath.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %v", err)
+	}
+
+	for _, hidden := range spec.Hide {
+		target := filepath.Join(root, hidden)
+		info, err := os.Stat(target)
+		if err != nil {
+			continue
+		}
+		// A directory is covered with an empty tmpfs, a file with /dev/null
+		if info.IsDir() {
+			err = syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755")
+		} else {
+			err = syscall.Mount("/dev/null", target, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to hide %s: %v", hidden, err)
+		}
+	}
+
+	// The workspace is the only writable host path
+	target := filepath.Join(root, spec.Workspace)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create workspace mount point: %v", err)
+	}
+	if err := syscall.Mount(spec.Workspace, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind workspace: %v", err)
+	}
+
+	// pivot_root(".", ".") stacks the old root on top of the new one so it
+	// can be detached without needing a writable put_old directory
+	if err := os.Chdir(root); err != nil {
+		return fmt.Errorf("failed to enter sandbox root: %v", err)
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("failed to pivot root: %v", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach host root: %v", err)
+	}
+	return os.Chdir("/")
+}
+
+// Remount every mount below root read-only, keeping each mount's flags
+func remountReadOnly(root string) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return fmt.Errorf("failed to read mountinfo: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[4])
+		if mountPoint != root && !strings.HasPrefix(mountPoint, root+"/") {
+			continue
+		}
+
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		for _, opt := range strings.Split(fields[5], ",") {
+			switch opt {
+			case "nosuid":
+				flags |= syscall.MS_NOSUID
+			case "nodev":
+				flags |= syscall.MS_NODEV
+			case "noexec":
+				flags |= syscall.MS_NOEXEC
+			case "noatime":
+				flags |= syscall.MS_NOATIME
+			case "nodiratime":
+				flags |= syscall.MS_NODIRATIME
+			case "relatime":
+				flags |= syscall.MS_RELATIME
+			}
+		}
+		if err := syscall.Mount("", mountPoint, "", flags, ""); err != nil {
+			// Pseudo filesystems are replaced or harmless, anything else must not stay writable
+			rel := strings.TrimPrefix(mountPoint, root)
+			if strings.HasPrefix(rel, "/proc") || strings.HasPrefix(rel, "/sys") || strings.HasPrefix(rel, "/dev") {
+				continue
+			}
+			return fmt.Errorf("failed to remount %s read-only: %v", rel, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// mountinfo escapes spaces, tabs, newlines and backslashes as octal
+func unescapeMountPath(path string) string {
+	r := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	return r.Replace(path)
+}
+
+// A fresh network namespace starts with lo down, so localhost would not work
+func bringUpLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var req struct {
+		Name  [syscall.IFNAMSIZ]byte
+		Flags uint16
+		_     [22]byte
+	}
+	copy(req.Name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	req.Flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Create a ruleset that handles every right the kernel knows about, so
+// anything not granted below is denied
+func buildLandlockRuleset(spec *landlockSpec) (int, error) {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return -1, fmt.Errorf("not supported by this kernel (%v), refusing to run unrestricted", errno)
+	}
+
+	handled := uint64(landlockAccessExecute | landlockAccessWriteFile | landlockAccessReadFile |
+		landlockAccessReadDir | landlockAccessRemoveDir | landlockAccessRemoveFile |
+		landlockAccessMakeChar | landlockAccessMakeDir | landlockAccessMakeReg |
+		landlockAccessMakeSock | landlockAccessMakeFifo | landlockAccessMakeBlock |
+		landlockAccessMakeSym)
+	if abi >= 2 {
+		handled |= landlockAccessRefer
+	}
+	if abi >= 3 {
+		handled |= landlockAccessTruncate
+	}
+	if abi >= 5 {
+		handled |= landlockAccessIoctlDev
+	}
+
+	attr := struct{ HandledAccessFs uint64 }{handled}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("failed to create ruleset: %v", errno)
+	}
+
+	for _, path := range spec.ReadOnly {
+		if err := addLandlockRule(int(fd), path, handled&landlockAccessRead); err != nil {
+			syscall.Close(int(fd))
+			return -1, err
+		}
+	}
+	for _, path := range spec.ReadWrite {
+		if err := addLandlockRule(int(fd), path, handled); err != nil {
+			syscall.Close(int(fd))
+			return -1, err
+		}
+	}
+	return int(fd), nil
+}
+
+// Grant access beneath path, skipping paths that do not exist
+func addLandlockRule(rulesetFd int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if err == syscall.ENOENT {
+			return nil
+		}
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockAccessFile
+	}
+
+	// struct landlock_path_beneath_attr is packed: u64 allowed_access, s32 parent_fd
+	var attr [12]byte
+	*(*uint64)(unsafe.Pointer(&attr[0])) = access
+	*(*int32)(unsafe.Pointer(&attr[8])) = int32(fd)
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFd), landlockRulePathBeneath,
+		uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to add rule for %s: %v", path, errno)
+	}
+	return nil
+}
+
+// Enforce the ruleset on this process and everything it execs
+func restrictLandlock(rulesetFd int) error {
+	defer syscall.Close(rulesetFd)
+	if _, _, errno := syscall.Syscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %v", errno)
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, uintptr(rulesetFd), 0, 0); errno != 0 {
+		return fmt.Errorf("failed to restrict self: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// applySandbox is only implemented on linux
+func applySandbox(cmd *exec.Cmd, spec *sandboxSpec) error {
+	return fmt.Errorf("namespace sandboxes are only supported on linux")
+}
+
+func sandboxInit() {
+	fmt.Fprintln(os.Stderr, "sandbox: only supported on linux")
+	os.Exit(126)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	storageFiles  = "files"
+	storageSQLite = "sqlite"
+
+	maxTicketTries = 1000 // Taken ticket numbers skipped before giving up
+)
+
+// Storage keeps the sessions and their tickets: the text the LLM reads as
+// NN.ticket, the NN.json metadata and the full NN.output. Session config,
+// jobs, schedules, uploads, edits, snapshots and artifacts stay as files in
+// the session folder whichever backend is used, so every backend creates
+// and removes that folder along with the session.
+type Storage interface {
+	SessionExists(session string) (bool, error)
+	CreateSession(session string) error
+	DeleteSession(session string) error
+	Sessions() ([]string, error)
+
+	// Reserve the next ticket of a session, creating the session if needed.
+	// Concurrent callers, even in other processes, get distinct tickets.
+	AllocateTicket(session string) (int, error)
+	// Tickets of a session in ascending order
+	Tickets(session string) ([]int, error)
+	// Text of a ticket, empty until it has a result. Errors satisfying
+	// os.IsNotExist mean the ticket was never allocated.
+	ReadTicket(session string, ticket int) ([]byte, error)
+	WriteTicket(session string, ticket int, content []byte) error
+
+	LoadMeta(session string, ticket int) (*TicketMeta, error)
+	SaveMeta(session string, meta *TicketMeta) error
+
+	// Start the full output of a ticket over, replacing any earlier one
+	CreateOutput(session string, ticket int) (io.WriteCloser, error)
+	// Read up to limit bytes of a ticket's full output from offset, along
+	// with its size so far
+	ReadOutput(session string, ticket int, offset int64, limit int) ([]byte, int64, error)
+
+	Close() error
+}
+
+var store Storage
+
+// Open the backend chosen with STORAGE
+func openStorage(kind string, path string) (Storage, error) {
+	switch kind {
+	case storageFiles:
+		return &fileStorage{dir: sessionsDir}, nil
+	case storageSQLite:
+		return openSQLiteStorage(path, sessionsDir)
+	}
+	return nil, fmt.Errorf("STORAGE must be '%s' or '%s': %s", storageFiles, storageSQLite, kind)
+}
+
+// Backends build folder names from sessions, so one that could reach out of
+// the sessions directory is refused before anything is created or removed
+func checkSession(session string) error {
+	if !validSession(session) {
+		return fmt.Errorf("invalid session name %q", session)
+	}
+	return nil
+}
+
+// fileStorage is the flat layout of one folder per session holding
+// NN.ticket, NN.json and NN.output for each ticket
+type fileStorage struct {
+	dir string
+	mu  sync.Mutex // Keeps this server's allocations apart
+}
+
+func (s *fileStorage) folder(session string) string {
+	return filepath.Join(s.dir, session)
+}
+
+func (s *fileStorage) ticketPath(session string, ticket int) string {
+	return filepath.Join(s.folder(session), fmt.Sprintf("%02d.ticket", ticket))
+}
+
+func (s *fileStorage) metaPath(session string, ticket int) string {
+	return filepath.Join(s.folder(session), fmt.Sprintf("%02d.json", ticket))
+}
+
+func (s *fileStorage) SessionExists(session string) (bool, error) {
+	_, err := os.Stat(s.folder(session))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *fileStorage) CreateSession(session string) error {
+	if err := checkSession(session); err != nil {
+		return err
+	}
+	return os.MkdirAll(s.folder(session), 0755)
+}
+
+func (s *fileStorage) DeleteSession(session string) error {
+	if err := checkSession(session); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.folder(session))
+}
+
+func (s *fileStorage) Sessions() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sessions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			sessions = append(sessions, entry.Name())
+		}
+	}
+	return sessions, nil
+}
+
+// Allocate by exclusively creating the empty ticket file. The mutex keeps
+// this server's requests apart and O_EXCL any other process sharing the
+// sessions directory.
+func (s *fileStorage) AllocateTicket(session string) (int, error) {
+	if err := checkSession(session); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ticket, err := getNextTicket(s.folder(session))
+	if err != nil {
+		return 0, err
+	}
+	for tries := 0; tries < maxTicketTries; tries++ {
+		ticketFile := s.ticketPath(session, ticket)
+		file, err := os.OpenFile(ticketFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return ticket, file.Close()
+		}
+		if !os.IsExist(err) {
+			return 0, fmt.Errorf("failed to reserve ticket %s: %v", ticketFile, err)
+		}
+		ticket++
+	}
+	return 0, fmt.Errorf("no free ticket found after %d tries", maxTicketTries)
+}
+
+func (s *fileStorage) Tickets(session string) ([]int, error) {
+	files, err := os.ReadDir(s.folder(session))
+	if err != nil {
+		return nil, err
+	}
+	var tickets []int
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".ticket" {
+			if ticket, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".ticket")); err == nil {
+				tickets = append(tickets, ticket)
+			}
+		}
+	}
+	sort.Ints(tickets)
+	return tickets, nil
+}
+
+func (s *fileStorage) ReadTicket(session string, ticket int) ([]byte, error) {
+	return os.ReadFile(s.ticketPath(session, ticket))
+}
+
+func (s *fileStorage) WriteTicket(session string, ticket int, content []byte) error {
+	return os.WriteFile(s.ticketPath(session, ticket), content, 0644)
+}
+
+func (s *fileStorage) LoadMeta(session string, ticket int) (*TicketMeta, error) {
+	data, err := os.ReadFile(s.metaPath(session, ticket))
+	if err != nil {
+		return nil, err
+	}
+	meta := &TicketMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *fileStorage) SaveMeta(session string, meta *TicketMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := s.metaPath(session, meta.Ticket)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *fileStorage) CreateOutput(session string, ticket int) (io.WriteCloser, error) {
+	return os.OpenFile(ticketOutputPath(s.folder(session), ticket), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (s *fileStorage) ReadOutput(session string, ticket int, offset int64, limit int) ([]byte, int64, error) {
+	file, err := os.Open(ticketOutputPath(s.folder(session), ticket))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, outputRange(offset, limit, info.Size()))
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	return buf[:n], info.Size(), nil
+}
+
+func (s *fileStorage) Close() error {
+	return nil
+}
+
+// Bytes a read of up to limit bytes from offset gets out of size bytes, so
+// no backend allocates more than the output holds
+func outputRange(offset int64, limit int, size int64) int {
+	if offset >= size || limit <= 0 {
+		return 0
+	}
+	if rest := size - offset; int64(limit) > rest {
+		return int(rest)
+	}
+	return limit
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sqliteChunkBytes  = 64 * 1024 // Full output is stored in rows of this size
+	sqliteBusyTimeout = 10 * time.Second
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	name    TEXT PRIMARY KEY,
+	created INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tickets (
+	session TEXT NOT NULL REFERENCES sessions(name) ON DELETE CASCADE,
+	ticket  INTEGER NOT NULL,
+	content BLOB NOT NULL DEFAULT '',
+	status  TEXT NOT NULL DEFAULT '',
+	meta    TEXT,
+	PRIMARY KEY (session, ticket)
+);
+CREATE INDEX IF NOT EXISTS tickets_status ON tickets(status);
+CREATE TABLE IF NOT EXISTS outputs (
+	session TEXT NOT NULL,
+	ticket  INTEGER NOT NULL,
+	start   INTEGER NOT NULL,
+	data    BLOB NOT NULL,
+	PRIMARY KEY (session, ticket, start),
+	FOREIGN KEY (session, ticket) REFERENCES tickets(session, ticket) ON DELETE CASCADE
+);
+`
+
+// sqliteStorage keeps sessions and tickets in one SQLite database, with
+// the full output of a ticket split over rows of its outputs table. The
+// session folders are still created for the files kept outside storage.
+type sqliteStorage struct {
+	db  *sql.DB
+	dir string
+}
+
+func openSQLiteStorage(path string, dir string) (*sqliteStorage, error) {
+	if path == "" {
+		path = filepath.Join(dir, "llmass.db")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// An absolute path keeps the URI from reading its first directory as a
+	// host, and url.URL escapes a '?' or '#' in it
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dsn := url.URL{Scheme: "file", Path: filepath.ToSlash(path), RawQuery: url.Values{
+		"_pragma": {fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()), "journal_mode(WAL)", "foreign_keys(1)"},
+		"_txlock": {"immediate"},
+	}.Encode()}
+	db, err := sql.Open("sqlite", dsn.String())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the schema of %s: %v", path, err)
+	}
+	s := &sqliteStorage{db: db, dir: dir}
+	if unseen, err := s.flatSessions(); err == nil && len(unseen) > 0 {
+		logger.Printf("%d sessions in %s hold flat-file tickets that %s does not see, such as %s. Nothing is migrated, set STORAGE=files to reach them.", len(unseen), dir, path, unseen[0])
+	}
+	return s, nil
+}
+
+// Session folders holding NN.ticket files written by the files backend that
+// the database has no row for
+func (s *sqliteStorage) flatSessions() ([]string, error) {
+	names, err := (&fileStorage{dir: s.dir}).Sessions()
+	if err != nil {
+		return nil, err
+	}
+	var unseen []string
+	for _, name := range names {
+		tickets, _ := filepath.Glob(filepath.Join(s.folder(name), "*.ticket"))
+		if len(tickets) == 0 {
+			continue
+		}
+		if exists, err := s.SessionExists(name); err != nil {
+			return nil, err
+		} else if !exists {
+			unseen = append(unseen, name)
+		}
+	}
+	return unseen, nil
+}
+
+func (s *sqliteStorage) folder(session string) string {
+	return filepath.Join(s.dir, session)
+}
+
+func (s *sqliteStorage) SessionExists(session string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM sessions WHERE name = ?)`, session).Scan(&exists)
+	return exists, err
+}
+
+func (s *sqliteStorage) CreateSession(session string) error {
+	if err := checkSession(session); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.folder(session), 0755); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO sessions (name, created) VALUES (?, ?)`, session, time.Now().Unix())
+	return err
+}
+
+func (s *sqliteStorage) DeleteSession(session string) error {
+	if err := checkSession(session); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM sessions WHERE name = ?`, session); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.folder(session))
+}
+
+func (s *sqliteStorage) Sessions() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM sessions ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, name)
+	}
+	return sessions, rows.Err()
+}
+
+// A single autocommit INSERT ... SELECT, which takes SQLite's write lock
+// before it reads MAX(ticket), so no two connections or processes get the
+// same ticket. _txlock=immediate plays no part, it only applies to BeginTx.
+func (s *sqliteStorage) AllocateTicket(session string) (int, error) {
+	if err := s.CreateSession(session); err != nil {
+		return 0, err
+	}
+	var ticket int
+	err := s.db.QueryRow(`INSERT INTO tickets (session, ticket)
+		SELECT ?, COALESCE(MAX(ticket), 0) + 1 FROM tickets WHERE session = ?
+		RETURNING ticket`, session, session).Scan(&ticket)
+	return ticket, err
+}
+
+func (s *sqliteStorage) Tickets(session string) ([]int, error) {
+	rows, err := s.db.Query(`SELECT ticket FROM tickets WHERE session = ? ORDER BY ticket`, session)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tickets []int
+	for rows.Next() {
+		var ticket int
+		if err := rows.Scan(&ticket); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+	return tickets, rows.Err()
+}
+
+func (s *sqliteStorage) ReadTicket(session string, ticket int) ([]byte, error) {
+	var content []byte
+	err := s.db.QueryRow(`SELECT content FROM tickets WHERE session = ? AND ticket = ?`, session, ticket).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, &os.PathError{Op: "read", Path: fmt.Sprintf("%s/%02d.ticket", session, ticket), Err: os.ErrNotExist}
+	}
+	return content, err
+}
+
+func (s *sqliteStorage) WriteTicket(session string, ticket int, content []byte) error {
+	_, err := s.db.Exec(`UPDATE tickets SET content = ? WHERE session = ? AND ticket = ?`, content, session, ticket)
+	return err
+}
+
+func (s *sqliteStorage) LoadMeta(session string, ticket int) (*TicketMeta, error) {
+	var data sql.NullString
+	err := s.db.QueryRow(`SELECT meta FROM tickets WHERE session = ? AND ticket = ?`, session, ticket).Scan(&data)
+	if err == sql.ErrNoRows || (err == nil && !data.Valid) {
+		return nil, &os.PathError{Op: "read", Path: fmt.Sprintf("%s/%02d.json", session, ticket), Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &TicketMeta{}
+	if err := json.Unmarshal([]byte(data.String), meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *sqliteStorage) SaveMeta(session string, meta *TicketMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE tickets SET meta = ?, status = ? WHERE session = ? AND ticket = ?`, string(data), meta.Status, session, meta.Ticket)
+	return err
+}
+
+func (s *sqliteStorage) CreateOutput(session string, ticket int) (io.WriteCloser, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM outputs WHERE session = ? AND ticket = ?`, session, ticket); err != nil {
+		return nil, err
+	}
+	// An empty first row marks that the ticket has an output, even before it printed anything
+	if _, err := tx.Exec(`INSERT INTO outputs (session, ticket, start, data) VALUES (?, ?, 0, x'')`, session, ticket); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &sqliteOutput{storage: s, session: session, ticket: ticket}, nil
+}
+
+func (s *sqliteStorage) ReadOutput(session string, ticket int, offset int64, limit int) ([]byte, int64, error) {
+	var size int64
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(start + LENGTH(data)), -1) FROM outputs WHERE session = ? AND ticket = ?`, session, ticket).Scan(&size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size < 0 {
+		return nil, 0, &os.PathError{Op: "open", Path: fmt.Sprintf("%s/%02d.output", session, ticket), Err: os.ErrNotExist}
+	}
+
+	limit = outputRange(offset, limit, size)
+	end := offset + int64(limit)
+	rows, err := s.db.Query(`SELECT start, data FROM outputs
+		WHERE session = ? AND ticket = ? AND start < ? AND start + LENGTH(data) > ?
+		ORDER BY start`, session, ticket, end, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	buf := make([]byte, 0, limit)
+	for rows.Next() {
+		var start int64
+		var data []byte
+		if err := rows.Scan(&start, &data); err != nil {
+			return nil, 0, err
+		}
+		if start < offset {
+			data = data[offset-start:]
+		}
+		if room := limit - len(buf); len(data) > room {
+			data = data[:room]
+		}
+		buf = append(buf, data...)
+	}
+	return buf, size, rows.Err()
+}
+
+func (s *sqliteStorage) Close() error {
+	return s.db.Close()
+}
+
+// sqliteOutput collects a ticket's output and stores it a row at a time, so
+// /output can page through it while the ticket is still running
+type sqliteOutput struct {
+	storage *sqliteStorage
+	session string
+	ticket  int
+	offset  int64
+	buf     []byte
+}
+
+func (o *sqliteOutput) Write(p []byte) (int, error) {
+	o.buf = append(o.buf, p...)
+	for len(o.buf) >= sqliteChunkBytes {
+		if err := o.flush(sqliteChunkBytes); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (o *sqliteOutput) flush(n int) error {
+	if _, err := o.storage.db.Exec(`INSERT OR REPLACE INTO outputs (session, ticket, start, data) VALUES (?, ?, ?, ?)`, o.session, o.ticket, o.offset, o.buf[:n]); err != nil {
+		return err
+	}
+	o.offset += int64(n)
+	o.buf = append(o.buf[:0], o.buf[n:]...)
+	return nil
+}
+
+func (o *sqliteOutput) Close() error {
+	if len(o.buf) == 0 {
+		return nil
+	}
+	return o.flush(len(o.buf))
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// applyIdentity makes cmd run as id instead of the server's own user
+func applyIdentity(cmd *exec.Cmd, id *Identity) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// An empty Groups slice still clears the inherited supplementary groups
+	groups := id.Groups
+	if groups == nil {
+		groups = []uint32{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    id.UID,
+		Gid:    id.GID,
+		Groups: groups,
+	}
+	cmd.Env = identityEnv(id)
+	return nil
+}
+
+// setProcessGroup starts cmd in its own process group so that stopping it
+// also reaches the processes it spawned
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcessGroup sends sig to the process group started by cmd
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// ownedBy reports whether the file described by info belongs to id
+func ownedBy(info os.FileInfo, id *Identity) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Uid == id.UID && st.Gid == id.GID
+}
+
+// identityCanRead reports whether id may read the file described by info,
+// going by its owner, group and permission bits
+func identityCanRead(info os.FileInfo, id *Identity) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	perm := info.Mode().Perm()
+	if st.Uid == id.UID {
+		return perm&0400 != 0
+	}
+	if st.Gid == id.GID {
+		return perm&0040 != 0
+	}
+	for _, gid := range id.Groups {
+		if st.Gid == gid {
+			return perm&0040 != 0
+		}
+	}
+	return perm&0004 != 0
+}
+
+// openedPath returns the path of the file open as f as the kernel sees it,
+// so checks made on it hold for the file that is read even when path was
+// swapped for a symlink after it was opened
+func openedPath(f *os.File, path string) (string, error) {
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(int(f.Fd())))
+}
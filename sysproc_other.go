@@ -0,0 +1,42 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// applyIdentity is only implemented on linux
+func applyIdentity(cmd *exec.Cmd, id *Identity) error {
+	return fmt.Errorf("running commands as %s is only supported on linux", id.User)
+}
+
+// setProcessGroup is a no-op outside linux
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup only reaches the process itself outside linux
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Signal(sig)
+}
+
+// ownedBy holds for every file outside linux, where identities are not
+// supported
+func ownedBy(info os.FileInfo, id *Identity) bool {
+	return true
+}
+
+// identityCanRead never grants access outside linux, where identities are
+// not supported
+func identityCanRead(info os.FileInfo, id *Identity) bool {
+	return false
+}
+
+// openedPath resolves path again outside linux, which has no /proc/self/fd
+// to ask which file f is
+func openedPath(f *os.File, path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}